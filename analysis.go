@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/notnil/chess"
+	"github.com/notnil/chess/uci"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultAnalysisTime = 500 * time.Millisecond
+
+// Evaluation is the engine's assessment of a position from White's point of
+// view.
+type Evaluation struct {
+	Centipawns int
+	// Mate is the number of moves until a forced mate, positive if White is
+	// mating. It is zero if there is no forced mate.
+	Mate int
+	// Outcome is set instead of the score for positions which are already
+	// checkmate or stalemate.
+	Outcome chess.Outcome
+}
+
+// Score maps the evaluation onto [-1, 1], where 1 means that White is
+// winning and -1 means that Black is winning. Centipawn scores are converted
+// to winning chances so that a pawn matters more in an equal position than
+// in an already won one.
+func (e Evaluation) Score() float64 {
+	switch {
+	case e.Outcome == chess.WhiteWon || e.Mate > 0:
+		return 1
+	case e.Outcome == chess.BlackWon || e.Mate < 0:
+		return -1
+	case e.Outcome == chess.Draw:
+		return 0
+	}
+	return 2/(1+math.Exp(-0.00368208*float64(e.Centipawns))) - 1
+}
+
+func (e Evaluation) String() string {
+	switch {
+	case e.Outcome != "" && e.Outcome != chess.NoOutcome:
+		return e.Outcome.String()
+	case e.Mate != 0:
+		return fmt.Sprintf("#%d", e.Mate)
+	}
+	return fmt.Sprintf("%+.1f", float64(e.Centipawns)/100)
+}
+
+// Analyzer evaluates positions using a UCI engine such as Stockfish.
+type Analyzer struct {
+	engine   *uci.Engine
+	moveTime time.Duration
+
+	// The engine can only search one position at a time, and the position
+	// and go commands need to be sent together.
+	lock sync.Mutex
+}
+
+func NewAnalyzer(enginePath string, moveTime time.Duration) (*Analyzer, error) {
+	engine, err := uci.New(enginePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := engine.Run(uci.CmdUCI, uci.CmdIsReady, uci.CmdUCINewGame); err != nil {
+		engine.Close()
+		return nil, err
+	}
+	if moveTime <= 0 {
+		moveTime = defaultAnalysisTime
+	}
+	return &Analyzer{engine: engine, moveTime: moveTime}, nil
+}
+
+// Evaluate returns the evaluation of the position.
+func (a *Analyzer) Evaluate(position *chess.Position) (*Evaluation, error) {
+	switch position.Status() {
+	case chess.Checkmate:
+		if position.Turn() == chess.White {
+			return &Evaluation{Outcome: chess.BlackWon}, nil
+		}
+		return &Evaluation{Outcome: chess.WhiteWon}, nil
+	case chess.Stalemate:
+		return &Evaluation{Outcome: chess.Draw}, nil
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	err := a.engine.Run(uci.CmdPosition{Position: position}, uci.CmdGo{MoveTime: a.moveTime})
+	if err != nil {
+		return nil, err
+	}
+
+	// The engine reports the score from the point of view of the side to
+	// move.
+	score := a.engine.SearchResults().Info.Score
+	evaluation := Evaluation{Centipawns: score.CP, Mate: score.Mate}
+	if position.Turn() == chess.Black {
+		evaluation.Centipawns = -evaluation.Centipawns
+		evaluation.Mate = -evaluation.Mate
+	}
+	return &evaluation, nil
+}
+
+// BestMove returns the move that the engine would play in the position.
+func (a *Analyzer) BestMove(position *chess.Position) (*chess.Move, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	err := a.engine.Run(uci.CmdPosition{Position: position}, uci.CmdGo{MoveTime: a.moveTime})
+	if err != nil {
+		return nil, err
+	}
+	move := a.engine.SearchResults().BestMove
+	if move == nil {
+		return nil, errors.New("the engine found no move")
+	}
+	return move, nil
+}
+
+func (a *Analyzer) Close() error {
+	return a.engine.Close()
+}
+
+// evaluatePosition evaluates the position if an engine is configured. It
+// returns nil if analysis is not available.
+func evaluatePosition(position *chess.Position) *Evaluation {
+	if App.analyzer == nil {
+		return nil
+	}
+	evaluation, err := App.analyzer.Evaluate(position)
+	if err != nil {
+		log.Errorf("Failed to evaluate position %s: %v", position, err)
+		return nil
+	}
+	return evaluation
+}
+
+// isBlunder returns whether the move that changed the evaluation from before
+// to after, played by mover, threw away a large part of the mover's winning
+// chances.
+func isBlunder(before, after Evaluation, mover chess.Color) bool {
+	drop := before.Score() - after.Score()
+	if mover == chess.Black {
+		drop = -drop
+	}
+	return drop >= 0.6
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/notnil/chess"
+)
+
+// nagGlyphs are the move assessment glyphs that players can write after
+// their moves, by their Numeric Annotation Glyph in the PGN.
+var nagGlyphs = map[string]int{
+	"!":  1,
+	"?":  2,
+	"!!": 3,
+	"??": 4,
+	"!?": 5,
+	"?!": 6,
+}
+
+var (
+	nagRegex         = regexp.MustCompile(`^\$(\d+)$`)
+	glyphSuffixRegex = regexp.MustCompile(`[!?]+$`)
+)
+
+// moveAnnotation is what a player said about their move: a NAG, which is 0
+// if they gave none, and a comment.
+type moveAnnotation struct {
+	nag     int
+	comment string
+}
+
+// parseNAG parses a glyph such as "!?" or a NAG such as "$5".
+func parseNAG(s string) (int, bool) {
+	if nag, ok := nagGlyphs[s]; ok {
+		return nag, true
+	}
+	if match := nagRegex.FindStringSubmatch(s); match != nil {
+		nag, err := strconv.Atoi(match[1])
+		return nag, err == nil && nag > 0 && nag < 256
+	}
+	return 0, false
+}
+
+// nagGlyph returns the glyph of the NAG, if it has one.
+func nagGlyph(nag int) (string, bool) {
+	for glyph, n := range nagGlyphs {
+		if n == nag {
+			return glyph, true
+		}
+	}
+	return "", false
+}
+
+// splitGlyph splits a glyph written straight after a move, as in "Nf3!?",
+// from the move.
+func splitGlyph(move string) (string, int) {
+	glyph := glyphSuffixRegex.FindString(move)
+	if nag, ok := parseNAG(glyph); ok {
+		return strings.TrimSuffix(move, glyph), nag
+	}
+	return move, 0
+}
+
+// parseAnnotatedMove splits a message with a move into the move and what the
+// player said about it, for example "Nf3 !? trying to provoke g5" or
+// "e4 {main idea}". The glyph can also be written straight after the move,
+// and the comment can be written with or without braces.
+func parseAnnotatedMove(body string) (string, moveAnnotation) {
+	body = strings.TrimSpace(body)
+	var annotation moveAnnotation
+	if start := strings.Index(body, "{"); start >= 0 {
+		comment := body[start+1:]
+		if end := strings.Index(comment, "}"); end >= 0 {
+			comment = comment[:end]
+		}
+		annotation.comment = strings.TrimSpace(comment)
+		body = body[:start]
+	}
+	fields := strings.Fields(body)
+	if len(fields) == 0 {
+		return "", annotation
+	}
+	move, nag := splitGlyph(fields[0])
+	fields = fields[1:]
+	if len(fields) > 0 {
+		if n, ok := parseNAG(fields[0]); ok && nag == 0 {
+			nag = n
+			fields = fields[1:]
+		}
+	}
+	annotation.nag = nag
+	if annotation.comment == "" {
+		annotation.comment = strings.Join(fields, " ")
+	}
+	// A brace would end the comment in the PGN.
+	annotation.comment = strings.NewReplacer("{", "", "}", "").Replace(annotation.comment)
+	return move, annotation
+}
+
+// annotateLastMove adds what the player said to the last move of the game.
+func annotateLastMove(game Game, annotation moveAnnotation) {
+	var nags [][]int
+	var comments [][]string
+	switch game := game.(type) {
+	case *StandardGame:
+		nags, comments = game.nags, game.comments
+	case *VariantGame:
+		nags, comments = game.nags, game.comments
+	default:
+		return
+	}
+	last := len(nags) - 1
+	if last < 0 {
+		return
+	}
+	if annotation.nag != 0 {
+		nags[last] = append(nags[last], annotation.nag)
+	}
+	if annotation.comment != "" {
+		comments[last] = append(comments[last], annotation.comment)
+	}
+}
+
+// moveNAGs returns the NAGs of the move of the game with the index.
+func moveNAGs(game Game, i int) []int {
+	var nags [][]int
+	switch game := game.(type) {
+	case *StandardGame:
+		nags = game.nags
+	case *VariantGame:
+		nags = game.nags
+	}
+	if i < len(nags) {
+		return nags[i]
+	}
+	return nil
+}
+
+// annotatedSAN returns the move of the game with the index in SAN, followed
+// by the glyphs that it was annotated with.
+func annotatedSAN(game Game, i int) string {
+	san := moveSAN(game, i)
+	for _, nag := range moveNAGs(game, i) {
+		if glyph, ok := nagGlyph(nag); ok {
+			san += glyph
+		} else {
+			san += fmt.Sprintf(" $%d", nag)
+		}
+	}
+	return san
+}
+
+// pgnMovetext returns the movetext of the PGN, after its tag pairs.
+func pgnMovetext(pgn string) string {
+	if last := variantTagRegex.FindAllStringIndex(pgn, -1); len(last) > 0 {
+		return pgn[last[len(last)-1][1]:]
+	}
+	return pgn
+}
+
+// writeMovetext writes the moves of a game in SAN to the PGN, numbered from
+// the move number of the starting position, with their NAGs and comments.
+func writeMovetext(pgn *strings.Builder, positions []*chess.Position, sans []string, nags [][]int, comments [][]string, outcome chess.Outcome) {
+	for i, san := range sans {
+		position := positions[i]
+		if position.Turn() == chess.White {
+			fmt.Fprintf(pgn, "%d. ", moveNumber(position))
+		} else if i == 0 {
+			fmt.Fprintf(pgn, "%d... ", moveNumber(position))
+		}
+		pgn.WriteString(san)
+		for _, nag := range nags[i] {
+			fmt.Fprintf(pgn, " $%d", nag)
+		}
+		for _, comment := range comments[i] {
+			fmt.Fprintf(pgn, " {%s}", comment)
+		}
+		pgn.WriteString(" ")
+	}
+	pgn.WriteString(outcome.String())
+}
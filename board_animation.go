@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+
+	"github.com/notnil/chess"
+	"golang.org/x/image/draw"
+)
+
+const (
+	// maxAnimatedPlies is the longest game that is animated. Every frame is
+	// rendered separately, so longer games take too long.
+	maxAnimatedPlies = 100
+
+	// Frame delays, in hundredths of a second.
+	animationFrameDelay = 100
+	animationFinalDelay = 300
+)
+
+// RenderGameAnimation renders every position of the game as a GIF that plays
+// once and stops on the final position.
+func RenderGameAnimation(game *chess.Game, style BoardStyle) (*RenderedImage, error) {
+	positions, moves := game.Positions(), game.Moves()
+	animation := gif.GIF{LoopCount: -1}
+	var final image.Image
+	for i, position := range positions {
+		render := BoardRender{Board: position.Board(), Style: style}
+		if i > 0 {
+			render.Highlights = []chess.Square{moves[i-1].S1(), moves[i-1].S2()}
+		}
+		pngBytes, err := boardToPngBytes(render)
+		if err != nil {
+			return nil, err
+		}
+		img, err := png.Decode(bytes.NewReader(pngBytes))
+		if err != nil {
+			return nil, err
+		}
+		frame := image.NewPaletted(img.Bounds(), palette.Plan9)
+		draw.FloydSteinberg.Draw(frame, img.Bounds(), img, image.Point{})
+		animation.Image = append(animation.Image, frame)
+		animation.Delay = append(animation.Delay, animationFrameDelay)
+		final = img
+	}
+	animation.Delay[len(animation.Delay)-1] = animationFinalDelay
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, &animation); err != nil {
+		return nil, err
+	}
+	// Clients show the thumbnail until the GIF plays, so use the final
+	// position for it rather than the first frame.
+	return newRenderedImage(buf.Bytes(), "image/gif", final)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+)
+
+const (
+	// maxGridPositions is the most positions that are drawn in one grid.
+	maxGridPositions = 12
+
+	gridPadding     = 12
+	gridLabelHeight = 20
+)
+
+// gridColumns returns the number of columns to lay out n boards in, keeping
+// the grid roughly square and no more than four boards wide.
+func gridColumns(n int) int {
+	columns := 1
+	for columns*columns < n && columns < 4 {
+		columns++
+	}
+	return columns
+}
+
+// RenderBoardGrid renders the boards side by side in a grid with a label
+// above each of them.
+func RenderBoardGrid(renders []BoardRender, labels []string) (*RenderedImage, error) {
+	boards := make([]image.Image, 0, len(renders))
+	cellWidth, cellHeight := 0, 0
+	for _, render := range renders {
+		pngBytes, err := boardToPngBytes(render)
+		if err != nil {
+			return nil, err
+		}
+		board, err := png.Decode(bytes.NewReader(pngBytes))
+		if err != nil {
+			return nil, err
+		}
+		boards = append(boards, board)
+		if board.Bounds().Dx() > cellWidth {
+			cellWidth = board.Bounds().Dx()
+		}
+		if board.Bounds().Dy() > cellHeight {
+			cellHeight = board.Bounds().Dy()
+		}
+	}
+	cellWidth += gridPadding
+	cellHeight += gridPadding + gridLabelHeight
+
+	columns := gridColumns(len(boards))
+	rows := (len(boards) + columns - 1) / columns
+	img := image.NewRGBA(image.Rect(0, 0, columns*cellWidth+gridPadding, rows*cellHeight+gridPadding))
+	fillRect(img, img.Bounds(), color.White)
+
+	for i, board := range boards {
+		x := gridPadding + (i%columns)*cellWidth
+		y := gridPadding + (i/columns)*cellHeight
+		drawText(img, x, y+gridLabelHeight-6, labels[i], evalAxisText)
+		bounds := board.Bounds()
+		draw.Draw(img, bounds.Sub(bounds.Min).Add(image.Pt(x, y+gridLabelHeight)), board, bounds.Min, draw.Src)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return newRenderedImage(buf.Bytes(), "image/png", img)
+}
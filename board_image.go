@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	svg "github.com/ajstarks/svgo"
+	"github.com/buckket/go-blurhash"
+	"github.com/notnil/chess"
+	cimage "github.com/notnil/chess/image"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/image/draw"
+)
+
+const (
+	// thumbnailMaxDimension is the maximum width or height of the thumbnails
+	// uploaded alongside board images.
+	thumbnailMaxDimension = 180
+
+	// The number of blurhash components in each direction. 4x4 is what most
+	// clients use and is plenty for a board.
+	blurhashComponentsX = 4
+	blurhashComponentsY = 4
+
+	// boardSize is the width and height of the board SVG that notnil/chess
+	// renders.
+	boardSize = 360
+	// marginHeight is the height of the player margins drawn above and below
+	// the board.
+	marginHeight = 48
+)
+
+// BoardTheme is the pair of colours used for the light and dark squares.
+type BoardTheme struct {
+	Light color.Color
+	Dark  color.Color
+}
+
+var boardThemes = map[string]BoardTheme{
+	"brown": {Light: color.RGBA{235, 209, 166, 1}, Dark: color.RGBA{165, 117, 81, 1}},
+	"blue":  {Light: color.RGBA{222, 227, 230, 1}, Dark: color.RGBA{140, 162, 173, 1}},
+	"green": {Light: color.RGBA{238, 238, 210, 1}, Dark: color.RGBA{118, 150, 86, 1}},
+}
+
+const defaultBoardTheme = "brown"
+
+// BoardStyle controls how a board is drawn, independently of what is on it.
+type BoardStyle struct {
+	Theme       string
+	Orientation chess.Color
+}
+
+// DefaultBoardStyle returns the style to use for boards that have not been
+// flipped, using the theme from the configuration.
+func DefaultBoardStyle() BoardStyle {
+	theme := App.configuration.BoardTheme
+	if _, ok := boardThemes[theme]; !ok {
+		theme = defaultBoardTheme
+	}
+	return BoardStyle{Theme: theme, Orientation: chess.White}
+}
+
+// BoardAnnotations is the game information drawn in the margins above and
+// below the board.
+type BoardAnnotations struct {
+	WhiteName string
+	BlackName string
+
+	// The piece types that each side has captured from the other.
+	CapturedByWhite []chess.PieceType
+	CapturedByBlack []chess.PieceType
+
+	// In variants with drops, the pieces in each side's pocket are drawn
+	// instead of the captured pieces and the material balance.
+	Pockets     bool
+	WhitePocket []chess.PieceType
+	BlackPocket []chess.PieceType
+
+	// In variants that count checks, the number of checks that each side has
+	// given is drawn in its margin.
+	Checks      bool
+	WhiteChecks int
+	BlackChecks int
+
+	MoveNumber int
+}
+
+func (a *BoardAnnotations) String() string {
+	pieceTypes := func(types []chess.PieceType) string {
+		var sb strings.Builder
+		for _, t := range types {
+			sb.WriteString(t.String())
+		}
+		return sb.String()
+	}
+	return strings.Join([]string{
+		a.WhiteName,
+		a.BlackName,
+		pieceTypes(a.CapturedByWhite),
+		pieceTypes(a.CapturedByBlack),
+		strconv.FormatBool(a.Pockets),
+		pieceTypes(a.WhitePocket),
+		pieceTypes(a.BlackPocket),
+		strconv.FormatBool(a.Checks),
+		strconv.Itoa(a.WhiteChecks),
+		strconv.Itoa(a.BlackChecks),
+		strconv.Itoa(a.MoveNumber),
+	}, "|")
+}
+
+// BoardRender describes everything that goes into a board image.
+type BoardRender struct {
+	Board      *chess.Board
+	Highlights []chess.Square
+	Style      BoardStyle
+
+	// Annotations is nil for boards that aren't part of a game, in which case
+	// the board is drawn without margins.
+	Annotations *BoardAnnotations
+
+	// Evaluation is drawn as a bar beside the board if it is set.
+	Evaluation *Evaluation
+}
+
+// CacheKey returns a key which uniquely identifies the rendered image. Two
+// renders with the same key produce identical images, so the uploaded media
+// can be reused.
+func (r BoardRender) CacheKey() string {
+	highlights := make([]string, 0, len(r.Highlights))
+	for _, sq := range r.Highlights {
+		highlights = append(highlights, sq.String())
+	}
+	sort.Strings(highlights)
+
+	parts := []string{
+		r.Board.String(),
+		strings.Join(highlights, ","),
+		r.Style.Theme,
+		r.Style.Orientation.String(),
+	}
+	if r.Annotations != nil {
+		parts = append(parts, r.Annotations.String())
+	}
+	if r.Evaluation != nil {
+		parts = append(parts, fmt.Sprintf("eval:%d:%d:%s", r.Evaluation.Centipawns, r.Evaluation.Mate, r.Evaluation.Outcome))
+	}
+	hash := sha256.Sum256([]byte(strings.Join(parts, "|")))
+	return hex.EncodeToString(hash[:])
+}
+
+// RenderedImage is a rendered image along with all of the metadata that
+// clients need to show a placeholder before the image has been downloaded.
+// The thumbnail is always a PNG.
+type RenderedImage struct {
+	Data     []byte
+	MimeType string
+	Width    int
+	Height   int
+
+	Thumbnail       []byte
+	ThumbnailWidth  int
+	ThumbnailHeight int
+
+	Blurhash string
+}
+
+func boardToPngBytes(render BoardRender) ([]byte, error) {
+	svgTempfile, err := os.CreateTemp(os.TempDir(), "chessboard-*.svg")
+	if err != nil {
+		return []byte{}, err
+	}
+	defer os.Remove(svgTempfile.Name())
+
+	// write board SVG to file
+	theme, ok := boardThemes[render.Style.Theme]
+	if !ok {
+		theme = boardThemes[defaultBoardTheme]
+	}
+	yellow := color.RGBA{255, 255, 0, 1}
+	colors := cimage.SquareColors(theme.Light, theme.Dark)
+	mark := cimage.MarkSquares(yellow, render.Highlights...)
+	perspective := cimage.Perspective(render.Style.Orientation)
+	var boardSVG bytes.Buffer
+	if err := cimage.SVG(&boardSVG, render.Board, colors, mark, perspective); err != nil {
+		log.Fatal(err)
+	}
+	if render.Annotations == nil {
+		_, err = svgTempfile.Write(boardSVG.Bytes())
+	} else {
+		err = writeAnnotatedBoardSVG(svgTempfile, boardSVG.String(), render)
+	}
+	if err != nil {
+		return []byte{}, err
+	}
+
+	pngTempfile, err := os.CreateTemp(os.TempDir(), "chessboard-*.png")
+	if err != nil {
+		return []byte{}, err
+	}
+	defer os.Remove(pngTempfile.Name())
+
+	cmd := exec.Command("convert", svgTempfile.Name(), pngTempfile.Name())
+	err = cmd.Run()
+	if err != nil {
+		return []byte{}, err
+	}
+
+	pngFile, err := os.Open(pngTempfile.Name())
+	if err != nil {
+		return []byte{}, err
+	}
+	defer pngFile.Close()
+
+	pngBytes, err := io.ReadAll(pngFile)
+	if err != nil || render.Evaluation == nil {
+		return pngBytes, err
+	}
+
+	boardTop := 0
+	if render.Annotations != nil {
+		boardTop = marginHeight
+	}
+	return addEvalBar(pngBytes, *render.Evaluation, render.Style.Orientation, boardTop)
+}
+
+var (
+	pieceValues = map[chess.PieceType]int{
+		chess.Pawn:   1,
+		chess.Knight: 3,
+		chess.Bishop: 3,
+		chess.Rook:   5,
+		chess.Queen:  9,
+	}
+	pieceGlyphs = map[chess.Piece]string{
+		chess.WhitePawn:   "\u2659",
+		chess.WhiteKnight: "\u2658",
+		chess.WhiteBishop: "\u2657",
+		chess.WhiteRook:   "\u2656",
+		chess.WhiteQueen:  "\u2655",
+		chess.WhiteKing:   "\u2654",
+		chess.BlackPawn:   "\u265F",
+		chess.BlackKnight: "\u265E",
+		chess.BlackBishop: "\u265D",
+		chess.BlackRook:   "\u265C",
+		chess.BlackQueen:  "\u265B",
+		chess.BlackKing:   "\u265A",
+	}
+)
+
+// materialBalance returns the material of white minus the material of black.
+func materialBalance(board *chess.Board) int {
+	balance := 0
+	for _, piece := range board.SquareMap() {
+		if piece.Color() == chess.White {
+			balance += pieceValues[piece.Type()]
+		} else {
+			balance -= pieceValues[piece.Type()]
+		}
+	}
+	return balance
+}
+
+// sortByValue sorts piece types from least to most valuable.
+func sortByValue(types []chess.PieceType) {
+	sort.SliceStable(types, func(i, j int) bool {
+		return pieceValues[types[i]] < pieceValues[types[j]]
+	})
+}
+
+// writeAnnotatedBoardSVG writes an SVG with the board in the middle and the
+// player margins above and below it. The player whose perspective the board
+// is drawn from is at the bottom.
+func writeAnnotatedBoardSVG(w io.Writer, boardSVG string, render BoardRender) error {
+	// Strip the XML declaration so that the board can be nested.
+	if strings.HasPrefix(boardSVG, "<?xml") {
+		boardSVG = boardSVG[strings.Index(boardSVG, "\n")+1:]
+	}
+
+	canvas := svg.New(w)
+	canvas.Start(boardSize, boardSize+2*marginHeight)
+	canvas.Rect(0, 0, boardSize, boardSize+2*marginHeight, "fill: #ffffff")
+
+	canvas.Group(fmt.Sprintf(`transform="translate(0,%d)"`, marginHeight))
+	if _, err := io.WriteString(canvas.Writer, boardSVG); err != nil {
+		return err
+	}
+	canvas.Gend()
+
+	top := render.Style.Orientation.Other()
+	drawPlayerMargin(canvas, 0, top, render)
+	drawPlayerMargin(canvas, marginHeight+boardSize, top.Other(), render)
+
+	if render.Annotations.MoveNumber > 0 {
+		canvas.Text(boardSize-8, 18, fmt.Sprintf("Move %d", render.Annotations.MoveNumber),
+			"text-anchor:end;font-size:13px;fill:#555555")
+	}
+
+	canvas.End()
+	return nil
+}
+
+func drawPlayerMargin(canvas *svg.SVG, y int, player chess.Color, render BoardRender) {
+	annotations := render.Annotations
+	name, captured := annotations.WhiteName, annotations.CapturedByWhite
+	if player == chess.Black {
+		name, captured = annotations.BlackName, annotations.CapturedByBlack
+	}
+	if name == "" {
+		name = colorName(player)
+	}
+	canvas.Text(8, y+18, name, "font-size:14px;font-weight:bold;fill:#000000")
+	if annotations.Checks {
+		checks := annotations.WhiteChecks
+		if player == chess.Black {
+			checks = annotations.BlackChecks
+		}
+		canvas.Text(boardSize-8, y+40, fmt.Sprintf("Checks: %d", checks),
+			"text-anchor:end;font-size:13px;fill:#555555")
+	}
+
+	if annotations.Pockets {
+		pocket := annotations.WhitePocket
+		if player == chess.Black {
+			pocket = annotations.BlackPocket
+		}
+		canvas.Text(8, y+40, pocketGlyphs(pocket, player), "font-size:18px;fill:#000000")
+		return
+	}
+
+	var glyphs strings.Builder
+	for _, pieceType := range captured {
+		glyphs.WriteString(pieceGlyphs[chess.NewPiece(pieceType, player.Other())])
+	}
+	balance := materialBalance(render.Board)
+	if player == chess.Black {
+		balance = -balance
+	}
+	if balance > 0 {
+		glyphs.WriteString(fmt.Sprintf(" +%d", balance))
+	}
+	canvas.Text(8, y+40, glyphs.String(), "font-size:18px;fill:#000000")
+}
+
+// pocketGlyphs returns the pieces in the pocket as glyphs of the player's
+// colour, with a count after the pieces that there are more than one of.
+func pocketGlyphs(pocket []chess.PieceType, player chess.Color) string {
+	glyphs := make([]string, 0, len(pocket))
+	for i := 0; i < len(pocket); {
+		n := 1
+		for i+n < len(pocket) && pocket[i+n] == pocket[i] {
+			n++
+		}
+		glyph := pieceGlyphs[chess.NewPiece(pocket[i], player)]
+		if n > 1 {
+			glyph += fmt.Sprintf("×%d", n)
+		}
+		glyphs = append(glyphs, glyph)
+		i += n
+	}
+	return strings.Join(glyphs, " ")
+}
+
+// RenderBoardImage renders the board to a PNG and computes the thumbnail and
+// blurhash for it.
+func RenderBoardImage(render BoardRender) (*RenderedImage, error) {
+	pngBytes, err := boardToPngBytes(render)
+	if err != nil {
+		return nil, err
+	}
+	return NewRenderedImage(pngBytes)
+}
+
+// NewRenderedImage computes the thumbnail and blurhash of a PNG.
+func NewRenderedImage(pngBytes []byte) (*RenderedImage, error) {
+	img, err := png.Decode(bytes.NewReader(pngBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode rendered image: %w", err)
+	}
+	return newRenderedImage(pngBytes, "image/png", img)
+}
+
+// newRenderedImage computes the thumbnail and blurhash of the image data from
+// img, which is the decoded image, or the frame that best represents it.
+func newRenderedImage(data []byte, mimeType string, img image.Image) (*RenderedImage, error) {
+	thumbnail := scaleToFit(img, thumbnailMaxDimension)
+	var thumbnailBuf bytes.Buffer
+	if err := png.Encode(&thumbnailBuf, thumbnail); err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+
+	// The blurhash only captures the low frequencies of the image, so it is
+	// much cheaper and just as good to compute it from the thumbnail.
+	hash, err := blurhash.Encode(blurhashComponentsX, blurhashComponentsY, thumbnail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute blurhash: %w", err)
+	}
+
+	return &RenderedImage{
+		Data:            data,
+		MimeType:        mimeType,
+		Width:           img.Bounds().Dx(),
+		Height:          img.Bounds().Dy(),
+		Thumbnail:       thumbnailBuf.Bytes(),
+		ThumbnailWidth:  thumbnail.Bounds().Dx(),
+		ThumbnailHeight: thumbnail.Bounds().Dy(),
+		Blurhash:        hash,
+	}, nil
+}
+
+// scaleToFit scales the image down so that neither dimension is larger than
+// maxDimension, preserving the aspect ratio.
+func scaleToFit(img image.Image, maxDimension int) image.Image {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if width <= maxDimension && height <= maxDimension {
+		return img
+	}
+	if width > height {
+		height = height * maxDimension / width
+		width = maxDimension
+	} else {
+		width = width * maxDimension / height
+		height = maxDimension
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, img.Bounds(), draw.Over, nil)
+	return scaled
+}
+
+// describePosition returns a textual description of the position to use as
+// the body of the board image event.
+func describePosition(position *chess.Position, lastMove string) string {
+	return describeBoard(position.String(), positionStatus(position), lastMove)
+}
+
+// describeBoard is describePosition with the FEN and the status given
+// separately, for variants that have more in their FEN than notnil/chess
+// knows about and other ways of ending the game.
+func describeBoard(fen, status, lastMove string) string {
+	description := fmt.Sprintf("Chess board: %s.", fen)
+	if lastMove != "" {
+		description += fmt.Sprintf(" Last move: %s.", lastMove)
+	}
+	return description + " " + status
+}
+
+// positionStatus says whether the side to move is checkmated or stalemated,
+// or that it is their move.
+func positionStatus(position *chess.Position) string {
+	switch position.Status() {
+	case chess.Checkmate:
+		return fmt.Sprintf("%s is checkmated.", colorName(position.Turn()))
+	case chess.Stalemate:
+		return "Stalemate."
+	default:
+		return fmt.Sprintf("%s to move.", colorName(position.Turn()))
+	}
+}
+
+func colorName(c chess.Color) string {
+	switch c {
+	case chess.White:
+		return "White"
+	case chess.Black:
+		return "Black"
+	default:
+		return ""
+	}
+}
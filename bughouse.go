@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/notnil/chess"
+	log "github.com/sirupsen/logrus"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// VariantBughouse is the value of the PGN Variant tag for the games on both
+// boards of a Bughouse match.
+const VariantBughouse = "Bughouse"
+
+// bughouseVariant is Bughouse, which is Crazyhouse on two boards where the
+// pieces captured on one board go to the partner on the other board.
+type bughouseVariant struct{}
+
+func (bughouseVariant) Name() string {
+	return VariantBughouse
+}
+
+func (bughouseVariant) StartingFEN() string {
+	return crazyhouseStartingFEN
+}
+
+func (bughouseVariant) Outcome(*variantPosition) (chess.Outcome, string) {
+	return chess.NoOutcome, ""
+}
+
+func (bughouseVariant) InsufficientMaterialDraws() bool {
+	return false
+}
+
+func (bughouseVariant) Evaluated() bool {
+	return false
+}
+
+// passesCaptures returns whether the pieces captured in the variant go to
+// the partner on the other board instead of the capturer's pocket.
+func passesCaptures(variant Variant) bool {
+	_, ok := variant.(bughouseVariant)
+	return ok
+}
+
+// BughouseBoard is the second board of a Bughouse match. The first board is
+// the game in the rest of the game state. The partners play opposite colours
+// on the two boards: White on the first board and Black on the second board
+// are a team, and so are Black on the first board and White on the second.
+type BughouseBoard struct {
+	GameID  string
+	PGN     string
+	White   mid.UserID
+	Black   mid.UserID
+	Pockets string
+}
+
+// state returns the game state of the second board, which shares the time
+// control and orientation of the first board.
+func (b *BughouseBoard) state(first *StateChessGameEventContent) *StateChessGameEventContent {
+	return &StateChessGameEventContent{
+		GameID:      b.GameID,
+		PGN:         b.PGN,
+		White:       b.White,
+		Black:       b.Black,
+		TimeControl: first.TimeControl,
+		Variant:     VariantBughouse,
+		Pockets:     b.Pockets,
+		Flipped:     first.Flipped,
+	}
+}
+
+func (p *variantPosition) removeFromPocket(piece chess.Piece) {
+	p.pockets[piece]--
+	if p.pockets[piece] <= 0 {
+		delete(p.pockets, piece)
+	}
+}
+
+// AddToPocket adds the piece to the pocket of its colour in the current
+// position.
+func (g *VariantGame) AddToPocket(piece chess.Piece) {
+	current := g.current()
+	current.pockets = copyPockets(current.pockets)
+	current.pockets[piece]++
+}
+
+// SetPockets replaces the pockets of the current position with the pieces,
+// written as in a FEN.
+func (g *VariantGame) SetPockets(pocket string) error {
+	pockets, err := parsePocketLetters(pocket)
+	if err != nil {
+		return err
+	}
+	g.current().pockets = pockets
+	return nil
+}
+
+// LastCapture returns the type of the piece captured by the last move, or
+// chess.NoPieceType if it didn't capture anything.
+func (g *VariantGame) LastCapture() chess.PieceType {
+	n := len(g.moves)
+	if n == 0 {
+		return chess.NoPieceType
+	}
+	return g.positions[n-1].capturedType(g.moves[n-1])
+}
+
+// End ends the game with the outcome for a reason outside of the game.
+func (g *VariantGame) End(outcome chess.Outcome, termination string) {
+	g.outcome, g.method, g.termination = outcome, chess.NoMethod, termination
+}
+
+// partnerOutcome returns the outcome on the other board of a Bughouse match
+// with the outcome, where the partners play the opposite colours.
+func partnerOutcome(outcome chess.Outcome) chess.Outcome {
+	switch outcome {
+	case chess.WhiteWon:
+		return chess.BlackWon
+	case chess.BlackWon:
+		return chess.WhiteWon
+	}
+	return outcome
+}
+
+// handleNewBughouseCommand starts a Bughouse match between the two teams.
+// Bughouse matches are never rated.
+func handleNewBughouseCommand(roomID mid.RoomID, args []string, gameState StateChessGameEventContent) {
+	usage := "Usage: new [minutes+increment] bughouse @white1 @black2 vs @black1 @white2. The players before vs are a team, playing White on board 1 and Black on board 2."
+	args = nonEmpty(args)
+	if len(args) != 5 || strings.ToLower(args[2]) != "vs" {
+		SendNotice(roomID, usage)
+		return
+	}
+	players := []mid.UserID{mid.UserID(args[0]), mid.UserID(args[1]), mid.UserID(args[3]), mid.UserID(args[4])}
+	seen := map[mid.UserID]bool{}
+	for _, player := range players {
+		if !strings.HasPrefix(string(player), "@") || seen[player] {
+			SendNotice(roomID, "A Bughouse match needs four different players. "+usage)
+			return
+		}
+		seen[player] = true
+	}
+
+	var games [2]*VariantGame
+	for i := range games {
+		game, err := NewVariantGame(bughouseVariant{}, crazyhouseStartingFEN)
+		if err != nil {
+			log.Errorf("Failed to start Bughouse game: %v", err)
+			return
+		}
+		games[i] = game
+	}
+	gameState.Rated = false
+	gameState.White, gameState.Black = players[0], players[2]
+	gameState.Bughouse = &BughouseBoard{GameID: newGameID(), White: players[3], Black: players[1]}
+
+	resp, err := sendBughouseBoards(roomID, &gameState, games, [2][]chess.Square{})
+	if err != nil {
+		log.Errorf("Failed to send Bughouse boards: %v", err)
+		return
+	}
+	gameState.BoardImageEventID = resp
+	abandonGame(roomID)
+	if err := saveBughouse(roomID, games, &gameState); err != nil {
+		log.Errorf("Failed to save Bughouse match %s: %v", gameState.GameID, err)
+	}
+}
+
+// loadBughouse parses the games on both boards of the match, with the
+// pockets from the game state.
+func loadBughouse(gameState *StateChessGameEventContent) ([2]*VariantGame, error) {
+	var games [2]*VariantGame
+	states := []*StateChessGameEventContent{gameState, gameState.Bughouse.state(gameState)}
+	for i, state := range states {
+		game, err := parseVariantPGN(bughouseVariant{}, state.PGN)
+		if err != nil {
+			return games, err
+		}
+		if err := game.SetPockets(state.Pockets); err != nil {
+			return games, err
+		}
+		games[i] = game
+	}
+	return games, nil
+}
+
+// saveBughouse saves both games of the match to the game archive and the
+// match to the room state.
+func saveBughouse(roomID mid.RoomID, games [2]*VariantGame, gameState *StateChessGameEventContent) error {
+	archiveGame(roomID, games[0], gameState)
+	second := gameState.Bughouse.state(gameState)
+	archiveGame(roomID, games[1], second)
+	gameState.Bughouse.PGN, gameState.Bughouse.Pockets = second.PGN, second.Pockets
+	_, err := App.client.SendStateEvent(roomID, StateChessGame, "", gameState)
+	return err
+}
+
+// sendBughouseBoards sends both boards side by side in one image. The second
+// board is shown the other way round from the first, so that each team sits
+// on the same side of both boards.
+func sendBughouseBoards(roomID mid.RoomID, gameState *StateChessGameEventContent, games [2]*VariantGame, highlights [2][]chess.Square) (mid.EventID, error) {
+	states := []*StateChessGameEventContent{gameState, gameState.Bughouse.state(gameState)}
+	renders := make([]BoardRender, 0, len(games))
+	lines := make([]string, 0, len(games))
+	for i, game := range games {
+		render := gameBoardRender(roomID, states[i], game, highlights[i]...)
+		if i == 1 {
+			render.Style.Orientation = render.Style.Orientation.Other()
+		}
+		renders = append(renders, render)
+		lines = append(lines, fmt.Sprintf("Board %d: %s", i+1, describeGamePosition(game)))
+	}
+
+	grid, err := RenderBoardGrid(renders, []string{"Board 1", "Board 2"})
+	if err != nil {
+		return "", err
+	}
+	uploaded, err := uploadImage(grid, "bughouse.png")
+	if err != nil {
+		return "", err
+	}
+	resp, err := SendImage(roomID, uploaded, strings.Join(lines, "\n"), nil)
+	if err != nil {
+		return "", err
+	}
+	return resp.EventID, nil
+}
+
+// handleBughouseMove plays the move on the board of the player who sent it,
+// if it is their turn, and passes any captured piece to their partner on
+// the other board. The match ends when the game on either board does.
+func handleBughouseMove(event *mevent.Event, gameState *StateChessGameEventContent, body string) {
+	games, err := loadBughouse(gameState)
+	if err != nil {
+		log.Errorf("Failed to load Bughouse match %s: %v", gameState.GameID, err)
+		return
+	}
+	states := []*StateChessGameEventContent{gameState, gameState.Bughouse.state(gameState)}
+	board := -1
+	var color chess.Color
+	for i, state := range states {
+		if state.White == event.Sender {
+			board, color = i, chess.White
+		} else if state.Black == event.Sender {
+			board, color = i, chess.Black
+		}
+	}
+	if board < 0 {
+		return
+	}
+	game, other := games[board], games[1-board]
+	if game.Position().Turn() != color {
+		return
+	}
+	move, annotation := parseAnnotatedMove(body)
+	if err := game.MoveStr(move); err != nil {
+		return
+	}
+	annotateLastMove(game, annotation)
+	if captured := game.LastCapture(); captured != chess.NoPieceType {
+		other.AddToPocket(chess.NewPiece(captured, color.Other()))
+	}
+	if outcome := game.Outcome(); outcome != chess.NoOutcome {
+		other.End(partnerOutcome(outcome), fmt.Sprintf("The game on board %d ended %s.", board+1, outcome))
+	}
+
+	var highlights [2][]chess.Square
+	moves := game.Moves()
+	last := moves[len(moves)-1]
+	highlights[board] = []chess.Square{last.S1(), last.S2()}
+
+	App.client.RedactEvent(event.RoomID, gameState.BoardImageEventID)
+	eventID, err := sendBughouseBoards(event.RoomID, gameState, games, highlights)
+	if err != nil {
+		log.Errorf("Failed to send Bughouse boards: %v", err)
+		return
+	}
+	gameState.BoardImageEventID = eventID
+	if err := saveBughouse(event.RoomID, games, gameState); err != nil {
+		log.Errorf("Failed to save Bughouse match %s: %v", gameState.GameID, err)
+		return
+	}
+
+	if games[0].Outcome() != chess.NoOutcome {
+		SendNotice(event.RoomID, bughouseResult(event.RoomID, gameState, games[0].Outcome()))
+	}
+}
+
+// bughouseResult announces the result of the match, given the outcome on
+// the first board.
+func bughouseResult(roomID mid.RoomID, gameState *StateChessGameEventContent, outcome chess.Outcome) string {
+	switch outcome {
+	case chess.WhiteWon:
+		return fmt.Sprintf("The match is over: %s and %s win.", getDisplayName(roomID, gameState.White), getDisplayName(roomID, gameState.Bughouse.Black))
+	case chess.BlackWon:
+		return fmt.Sprintf("The match is over: %s and %s win.", getDisplayName(roomID, gameState.Black), getDisplayName(roomID, gameState.Bughouse.White))
+	}
+	return "The match is over: it's a draw."
+}
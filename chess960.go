@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/notnil/chess"
+)
+
+// VariantChess960 is the value of the PGN Variant tag for Chess960 games.
+const VariantChess960 = "Chess960"
+
+// chess960Variant is Chess960, whose castling rules VariantGame follows.
+type chess960Variant struct{}
+
+func (chess960Variant) Name() string {
+	return VariantChess960
+}
+
+// StartingFEN returns the standard starting position, which is Chess960
+// position 518. New games are started from a random position instead.
+func (chess960Variant) StartingFEN() string {
+	return chess.StartingPosition().String()
+}
+
+func (chess960Variant) Outcome(*variantPosition) (chess.Outcome, string) {
+	return chess.NoOutcome, ""
+}
+
+func (chess960Variant) InsufficientMaterialDraws() bool {
+	return true
+}
+
+func (chess960Variant) Evaluated() bool {
+	return true
+}
+
+// chess960Positions is the number of Chess960 starting positions.
+const chess960Positions = 960
+
+// chess960KnightPlacements lists where the knights go among the five squares
+// left after placing the bishops and the queen, in Scharnagl's numbering.
+var chess960KnightPlacements = [10][2]int{
+	{0, 1}, {0, 2}, {0, 3}, {0, 4}, {1, 2}, {1, 3}, {1, 4}, {2, 3}, {2, 4}, {3, 4},
+}
+
+// chess960BackRank returns White's back rank of the Chess960 starting
+// position with Scharnagl's number id. Position 518 is the standard one.
+func chess960BackRank(id int) string {
+	var rank [8]byte
+	empty := func() []int {
+		files := make([]int, 0, 8)
+		for file, piece := range rank {
+			if piece == 0 {
+				files = append(files, file)
+			}
+		}
+		return files
+	}
+
+	rank[2*(id%4)+1] = 'B'
+	id /= 4
+	rank[2*(id%4)] = 'B'
+	id /= 4
+	rank[empty()[id%6]] = 'Q'
+	id /= 6
+	files := empty()
+	rank[files[chess960KnightPlacements[id][0]]] = 'N'
+	rank[files[chess960KnightPlacements[id][1]]] = 'N'
+	files = empty()
+	rank[files[0]], rank[files[1]], rank[files[2]] = 'R', 'K', 'R'
+	return string(rank[:])
+}
+
+// chess960FEN returns the X-FEN of the Chess960 starting position with
+// Scharnagl's number id.
+func chess960FEN(id int) string {
+	backRank := chess960BackRank(id)
+	return fmt.Sprintf("%s/pppppppp/8/8/8/8/PPPPPPPP/%s w KQkq - 0 1", strings.ToLower(backRank), backRank)
+}
+
+// randomChess960ID picks one of the starting positions at random.
+func randomChess960ID() int {
+	n, err := rand.Int(rand.Reader, big.NewInt(chess960Positions))
+	if err != nil {
+		panic(err)
+	}
+	return int(n.Int64())
+}
+
+// newChess960Game starts a Chess960 game from the starting position with
+// Scharnagl's number id.
+func newChess960Game(id int) (*VariantGame, error) {
+	if id < 0 || id >= chess960Positions {
+		return nil, fmt.Errorf("there is no Chess960 position %d", id)
+	}
+	return NewVariantGame(chess960Variant{}, chess960FEN(id))
+}
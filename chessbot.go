@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	log "github.com/sirupsen/logrus"
@@ -23,9 +24,18 @@ type ChessBot struct {
 	configuration Configuration
 	olmMachine    *mcrypto.OlmMachine
 	stateStore    *store.StateStore
+	analyzer      *Analyzer
 
 	// Bot state
-	fenImageStore *store.FenImageStore
+	fenImageStore     *store.FenImageStore
+	boardImageCache   *store.BoardImageCache
+	gameStore         *store.GameStore
+	ratingStore       *store.RatingStore
+	importedGameStore *store.ImportedGameStore
+	replayStore       *store.ReplayStore
+	explorationStore  *store.ExplorationStore
+	moveEventStore    *store.MoveEventStore
+	voteStore         *store.VoteStore
 }
 
 var App ChessBot
@@ -98,6 +108,9 @@ func main() {
 	go func() {
 		for range c { // when the process is killed
 			log.Info("Cleaning up")
+			if App.analyzer != nil {
+				App.analyzer.Close()
+			}
 			db.Close()
 			os.Exit(0)
 		}
@@ -113,6 +126,54 @@ func main() {
 		log.Fatal("Failed to create the tables for fen image store.", err)
 	}
 
+	App.boardImageCache = &store.BoardImageCache{DB: db}
+	if err := App.boardImageCache.CreateTables(); err != nil {
+		log.Fatal("Failed to create the tables for board image cache.", err)
+	}
+
+	App.gameStore = &store.GameStore{DB: db}
+	if err := App.gameStore.CreateTables(); err != nil {
+		log.Fatal("Failed to create the tables for game store.", err)
+	}
+
+	App.ratingStore = &store.RatingStore{DB: db}
+	if err := App.ratingStore.CreateTables(); err != nil {
+		log.Fatal("Failed to create the tables for rating store.", err)
+	}
+
+	App.importedGameStore = &store.ImportedGameStore{DB: db}
+	if err := App.importedGameStore.CreateTables(); err != nil {
+		log.Fatal("Failed to create the tables for imported game store.", err)
+	}
+
+	App.replayStore = &store.ReplayStore{DB: db}
+	if err := App.replayStore.CreateTables(); err != nil {
+		log.Fatal("Failed to create the tables for replay store.", err)
+	}
+
+	App.explorationStore = &store.ExplorationStore{DB: db}
+	if err := App.explorationStore.CreateTables(); err != nil {
+		log.Fatal("Failed to create the tables for exploration store.", err)
+	}
+
+	App.moveEventStore = &store.MoveEventStore{DB: db}
+	if err := App.moveEventStore.CreateTables(); err != nil {
+		log.Fatal("Failed to create the tables for move event store.", err)
+	}
+
+	App.voteStore = &store.VoteStore{DB: db}
+	if err := App.voteStore.CreateTables(); err != nil {
+		log.Fatal("Failed to create the tables for vote store.", err)
+	}
+
+	if App.configuration.EnginePath != "" {
+		analysisTime := time.Duration(App.configuration.AnalysisTimeMS) * time.Millisecond
+		App.analyzer, err = NewAnalyzer(App.configuration.EnginePath, analysisTime)
+		if err != nil {
+			log.Errorf("Could not start the chess engine at %s. Analysis will not be available. %v", App.configuration.EnginePath, err)
+		}
+	}
+
 	log.Infof("Logging in %s", App.configuration.Username)
 	password, err := App.configuration.GetPassword()
 	if err != nil {
@@ -200,18 +261,33 @@ func main() {
 
 	syncer.OnEventType(mevent.EventMessage, func(source mautrix.EventSource, event *mevent.Event) { go HandleMessage(source, event) })
 
+	syncer.OnEventType(mevent.EventReaction, func(source mautrix.EventSource, event *mevent.Event) { go HandleReaction(source, event) })
+
+	registerPollEventTypes()
+	syncer.OnEventType(EventPollResponse, func(source mautrix.EventSource, event *mevent.Event) { go HandlePollResponse(source, event) })
+	syncer.OnEventType(EventPollResponseUnstable, func(source mautrix.EventSource, event *mevent.Event) { go HandlePollResponse(source, event) })
+
+	syncer.OnEventType(mevent.EventRedaction, func(source mautrix.EventSource, event *mevent.Event) { go HandleRedaction(source, event) })
+
 	syncer.OnEventType(mevent.EventEncrypted, func(source mautrix.EventSource, event *mevent.Event) {
 		decryptedEvent, err := App.olmMachine.DecryptMegolmEvent(event)
 		if err != nil {
 			log.Errorf("Failed to decrypt message from %s in %s: %+v", event.Sender, event.RoomID, err)
 		} else {
 			log.Debugf("Received encrypted event from %s in %s", event.Sender, event.RoomID)
-			if decryptedEvent.Type == mevent.EventMessage {
+			switch decryptedEvent.Type {
+			case mevent.EventMessage:
 				go HandleMessage(source, decryptedEvent)
+			case mevent.EventReaction:
+				go HandleReaction(source, decryptedEvent)
+			case EventPollResponse, EventPollResponseUnstable:
+				go HandlePollResponse(source, decryptedEvent)
 			}
 		}
 	})
 
+	go resumeVoteGames()
+
 	for {
 		log.Debugf("Running sync...")
 		err = App.client.Sync()
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/notnil/chess"
+	log "github.com/sirupsen/logrus"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// claimMethods are the draws that only happen when a player claims them,
+// unlike the automatic fivefold repetition and seventy-five-move draws.
+var claimMethods = []chess.Method{chess.ThreefoldRepetition, chess.FiftyMoveRule}
+
+// EligibleDraws returns the draws that can be claimed in the current
+// position, like chess.Game.EligibleDraws.
+func (g *VariantGame) EligibleDraws() []chess.Method {
+	draws := []chess.Method{chess.DrawOffer}
+	repetitions := 0
+	for _, p := range g.positions {
+		if p.repetitionKey() == g.current().repetitionKey() {
+			repetitions++
+		}
+	}
+	if repetitions >= 3 {
+		draws = append(draws, chess.ThreefoldRepetition)
+	}
+	if g.Position().HalfMoveClock() >= 100 {
+		draws = append(draws, chess.FiftyMoveRule)
+	}
+	return draws
+}
+
+// Draw ends the game as a draw by the method, if it can be claimed.
+func (g *VariantGame) Draw(method chess.Method) error {
+	eligible := false
+	for _, draw := range g.EligibleDraws() {
+		eligible = eligible || draw == method
+	}
+	if !eligible {
+		return fmt.Errorf("a draw by %s can't be claimed", method)
+	}
+	g.outcome, g.method = chess.Draw, method
+	return nil
+}
+
+// claimName names the draw for the players.
+func claimName(method chess.Method) string {
+	if method == chess.FiftyMoveRule {
+		return "the fifty-move rule"
+	}
+	return "threefold repetition"
+}
+
+// claimableDraws returns the draws that the player to move can claim.
+func claimableDraws(game Game) []chess.Method {
+	var draws []chess.Method
+	if game.Outcome() != chess.NoOutcome {
+		return draws
+	}
+	for _, draw := range game.EligibleDraws() {
+		for _, method := range claimMethods {
+			if draw == method {
+				draws = append(draws, draw)
+			}
+		}
+	}
+	return draws
+}
+
+// claimDraw ends the game as a draw if the player to move can claim one, or
+// explains why they can't.
+func claimDraw(game Game) error {
+	draws := claimableDraws(game)
+	if len(draws) == 0 {
+		clock := game.Position().HalfMoveClock()
+		return fmt.Errorf("the position hasn't occurred three times, and there have been %d moves without a capture or a pawn move, not 50", clock/2)
+	}
+	return drawGame(game, draws[0])
+}
+
+// drawGame ends the game as a draw by the method. The PGN only keeps the
+// result, so the Termination tag records how the game was drawn.
+func drawGame(game Game, method chess.Method) error {
+	if err := game.Draw(method); err != nil {
+		return err
+	}
+	game.AddTagPair("Termination", method.String())
+	return nil
+}
+
+// drawMethod returns how the game was drawn by agreement or by a claim, or
+// NoMethod if it wasn't, reading the Termination tag of games parsed from
+// their PGN.
+func drawMethod(game Game) chess.Method {
+	for _, method := range append([]chess.Method{chess.DrawOffer}, claimMethods...) {
+		if game.Method() == method {
+			return method
+		}
+		if tag := game.GetTagPair("Termination"); tag != nil && game.Outcome() == chess.Draw && tag.Value == method.String() {
+			return method
+		}
+	}
+	return chess.NoMethod
+}
+
+// splitClaim takes a claim written with a move, as in "Nf3 claim", off the
+// move. The claim has to come straight after the move, so that "claim"
+// anywhere else is left in the comment.
+func splitClaim(body string) (string, bool) {
+	fields := strings.Fields(body)
+	if len(fields) < 2 || !strings.EqualFold(fields[1], "claim") {
+		return body, false
+	}
+	return strings.Join(append(fields[:1:1], fields[2:]...), " "), true
+}
+
+// claimNotice tells the player to move that they can claim a draw, or
+// returns an empty string if they can't.
+func claimNotice(roomID mid.RoomID, gameState *StateChessGameEventContent, game Game) string {
+	draws := claimableDraws(game)
+	if len(draws) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(draws))
+	for _, draw := range draws {
+		names = append(names, claimName(draw))
+	}
+	turn := game.Position().Turn()
+	player := colorName(turn)
+	if userID := gameState.Player(turn); userID != "" {
+		player = getDisplayName(roomID, userID)
+	}
+	return fmt.Sprintf("%s can claim a draw by %s with !chess claim.", player, strings.Join(names, " or "))
+}
+
+// handleClaimCommand ends the current game as a draw if the player to move
+// can claim one.
+func handleClaimCommand(event *mevent.Event) {
+	gameState, err := getGameStateEvent(event.RoomID)
+	if err != nil {
+		SendNotice(event.RoomID, "There is no game to claim a draw in.")
+		return
+	}
+	if gameState.Bughouse != nil {
+		SendNotice(event.RoomID, "Draws can't be claimed in Bughouse matches.")
+		return
+	}
+	game, err := gameState.parseGame()
+	if err != nil {
+		log.Errorf("Failed to parse game %s: %v", gameState.GameID, err)
+		return
+	}
+	if game.Outcome() != chess.NoOutcome {
+		SendNotice(event.RoomID, "The game is already over.")
+		return
+	}
+	if gameState.Player(game.Position().Turn()) != event.Sender {
+		SendNotice(event.RoomID, "Only the player to move can claim a draw.")
+		return
+	}
+	if err := claimDraw(game); err != nil {
+		SendNotice(event.RoomID, fmt.Sprintf("Can't claim a draw: %v.", err))
+		return
+	}
+	if _, err := saveGame(event.RoomID, game, gameState); err != nil {
+		log.Errorf("Failed to save game %s: %v", gameState.GameID, err)
+		return
+	}
+	SendNotice(event.RoomID, gameStatus(game))
+	finishGame(event.RoomID, gameState, game)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/notnil/chess"
+)
+
+func TestSplitClaim(t *testing.T) {
+	testCases := []struct {
+		body  string
+		move  string
+		claim bool
+	}{
+		{"Nf3", "Nf3", false},
+		{"Nf3 claim", "Nf3", true},
+		{"Nf3 CLAIM", "Nf3", true},
+		{"Nf3!? claim {heading for a draw}", "Nf3!? {heading for a draw}", true},
+		{"Nf3 {heading for a draw} claim", "Nf3 {heading for a draw} claim", false},
+		{"Nf3 staking my claim", "Nf3 staking my claim", false},
+		{"Nf3  claim ", "Nf3", true},
+		{"claim", "claim", false},
+		{"claim Nf3", "claim Nf3", false},
+		{"Nf3 {I claim nothing} here", "Nf3 {I claim nothing} here", false},
+		{"", "", false},
+	}
+	for _, tc := range testCases {
+		move, claim := splitClaim(tc.body)
+		if move != tc.move || claim != tc.claim {
+			t.Errorf("splitClaim(%q) = %q, %v, want %q, %v", tc.body, move, claim, tc.move, tc.claim)
+		}
+	}
+}
+
+func TestClaimDraw(t *testing.T) {
+	testCases := []struct {
+		name   string
+		moves  string
+		method chess.Method
+	}{
+		{"threefold repetition", "Nf3 Nf6 Ng1 Ng8 Nf3 Nf6 Ng1 Ng8", chess.ThreefoldRepetition},
+		{"twofold repetition", "Nf3 Nf6 Ng1 Ng8", chess.NoMethod},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			game, err := parseStandardPGN("*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, move := range strings.Fields(tc.moves) {
+				if err := game.MoveStr(move); err != nil {
+					t.Fatalf("move %s: %v", move, err)
+				}
+			}
+			err = claimDraw(game)
+			if tc.method == chess.NoMethod {
+				if err == nil {
+					t.Errorf("the draw was claimed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if game.Outcome() != chess.Draw || game.Method() != tc.method {
+				t.Errorf("outcome %s by %s, want a draw by %s", game.Outcome(), game.Method(), tc.method)
+			}
+
+			// The claim survives a round trip through the PGN.
+			parsed, err := parseGamePGN(game.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if method := drawMethod(parsed); parsed.Outcome() != chess.Draw || method != tc.method {
+				t.Errorf("outcome %s by %s after parsing the PGN, want a draw by %s", parsed.Outcome(), method, tc.method)
+			}
+			if status := gameStatus(parsed); status != gameStatus(game) {
+				t.Errorf("gameStatus() = %q after parsing the PGN, want %q", status, gameStatus(game))
+			}
+		})
+	}
+}
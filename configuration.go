@@ -13,6 +13,17 @@ type Configuration struct {
 	Homeserver   string `yaml:"homeserver"`
 	Username     string `yaml:"username"`
 	PasswordFile string `yaml:"password_file"`
+
+	// Rendering settings
+	BoardTheme string `yaml:"board_theme"`
+	AnimatePGN bool   `yaml:"animate_pgn"`
+
+	// Analysis settings
+	EnginePath     string `yaml:"engine_path"`
+	AnalysisTimeMS int    `yaml:"analysis_time_ms"`
+
+	// Vote chess settings
+	VoteWindowSeconds int `yaml:"vote_window_seconds"`
 }
 
 func (c *Configuration) Parse(data []byte) error {
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/notnil/chess"
+)
+
+// VariantCrazyhouse is the value of the PGN Variant tag for Crazyhouse games.
+const VariantCrazyhouse = "Crazyhouse"
+
+// crazyhouseStartingFEN is the standard starting position with empty pockets.
+const crazyhouseStartingFEN = "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR[] w KQkq - 0 1"
+
+// pocketPieceTypes are the piece types that can be in a pocket, from most to
+// least valuable, which is the order they are written in a FEN.
+var pocketPieceTypes = []chess.PieceType{chess.Queen, chess.Rook, chess.Bishop, chess.Knight, chess.Pawn}
+
+// pieceTypeNames names the piece types that can be dropped.
+var pieceTypeNames = map[chess.PieceType]string{
+	chess.Queen: "queen", chess.Rook: "rook", chess.Bishop: "bishop", chess.Knight: "knight", chess.Pawn: "pawn",
+}
+
+var dropInputRegex = regexp.MustCompile(`^([PNBRQpnbrq]?)@([a-h][1-8])[+#]?[!?]*$`)
+
+// crazyhouseVariant is Crazyhouse. Its starting position has pockets, which
+// is what makes VariantGame allow drops.
+type crazyhouseVariant struct{}
+
+func (crazyhouseVariant) Name() string {
+	return VariantCrazyhouse
+}
+
+func (crazyhouseVariant) StartingFEN() string {
+	return crazyhouseStartingFEN
+}
+
+func (crazyhouseVariant) Outcome(*variantPosition) (chess.Outcome, string) {
+	return chess.NoOutcome, ""
+}
+
+// InsufficientMaterialDraws is false because captured pieces can come back.
+func (crazyhouseVariant) InsufficientMaterialDraws() bool {
+	return false
+}
+
+// Evaluated is false because the engine doesn't know about drops.
+func (crazyhouseVariant) Evaluated() bool {
+	return false
+}
+
+// pieceLetter returns the FEN letter of the piece: upper case for White and
+// lower case for Black.
+func pieceLetter(piece chess.Piece) string {
+	letter := piece.Type().String()
+	if piece.Color() == chess.White {
+		return strings.ToUpper(letter)
+	}
+	return letter
+}
+
+// parsePockets splits the board field of a FEN into the board and the
+// pockets, which are either in brackets after the board or a ninth rank. The
+// pockets are nil if there are none.
+func parsePockets(field string) (string, map[chess.Piece]int, error) {
+	var board, pocket string
+	if i := strings.Index(field, "["); i >= 0 {
+		if !strings.HasSuffix(field, "]") {
+			return "", nil, fmt.Errorf("the pockets in %s aren't closed", field)
+		}
+		board, pocket = field[:i], field[i+1:len(field)-1]
+	} else if ranks := strings.Split(field, "/"); len(ranks) == 9 {
+		board, pocket = strings.Join(ranks[:8], "/"), ranks[8]
+	} else {
+		return field, nil, nil
+	}
+	pockets, err := parsePocketLetters(pocket)
+	return board, pockets, err
+}
+
+// parsePocketLetters parses the pieces in the pockets, written as in a FEN.
+func parsePocketLetters(pocket string) (map[chess.Piece]int, error) {
+	pockets := map[chess.Piece]int{}
+	for _, r := range pocket {
+		found := false
+		for _, pieceType := range pocketPieceTypes {
+			for _, color := range []chess.Color{chess.White, chess.Black} {
+				if piece := chess.NewPiece(pieceType, color); pieceLetter(piece) == string(r) {
+					pockets[piece]++
+					found = true
+				}
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%q can't be in a pocket", r)
+		}
+	}
+	return pockets, nil
+}
+
+// parsePromoted removes the tildes that mark promoted pieces from the board
+// field of a FEN and returns their squares.
+func parsePromoted(board string) (string, map[chess.Square]bool) {
+	if !strings.Contains(board, "~") {
+		return board, nil
+	}
+	promoted := map[chess.Square]bool{}
+	for i, rank := range strings.Split(board, "/") {
+		file := 0
+		for _, r := range rank {
+			switch {
+			case r == '~':
+				promoted[chess.NewSquare(chess.File(file-1), chess.Rank(7-i))] = true
+			case r >= '1' && r <= '8':
+				file += int(r - '0')
+			default:
+				file++
+			}
+		}
+	}
+	return strings.ReplaceAll(board, "~", ""), promoted
+}
+
+// boardFEN returns the board field of a FEN, with promoted pieces marked with
+// a tilde.
+func boardFEN(board *chess.Board, promoted map[chess.Square]bool) string {
+	var fen strings.Builder
+	for r := chess.Rank8; r >= chess.Rank1; r-- {
+		empty := 0
+		for f := chess.FileA; f <= chess.FileH; f++ {
+			sq := chess.NewSquare(f, r)
+			piece := board.Piece(sq)
+			if piece == chess.NoPiece {
+				empty++
+				continue
+			}
+			if empty > 0 {
+				fen.WriteString(strconv.Itoa(empty))
+				empty = 0
+			}
+			fen.WriteString(pieceLetter(piece))
+			if promoted[sq] {
+				fen.WriteString("~")
+			}
+		}
+		if empty > 0 {
+			fen.WriteString(strconv.Itoa(empty))
+		}
+		if r > chess.Rank1 {
+			fen.WriteString("/")
+		}
+	}
+	return fen.String()
+}
+
+// pocketString returns the pockets as they are written in a FEN, with
+// White's pieces first.
+func pocketString(pockets map[chess.Piece]int) string {
+	var pocket strings.Builder
+	for _, color := range []chess.Color{chess.White, chess.Black} {
+		for _, pieceType := range pocketPieceTypes {
+			piece := chess.NewPiece(pieceType, color)
+			pocket.WriteString(strings.Repeat(pieceLetter(piece), pockets[piece]))
+		}
+	}
+	return pocket.String()
+}
+
+func copyPockets(pockets map[chess.Piece]int) map[chess.Piece]int {
+	if pockets == nil {
+		return nil
+	}
+	copied := make(map[chess.Piece]int, len(pockets))
+	for piece, n := range pockets {
+		copied[piece] = n
+	}
+	return copied
+}
+
+func copyPromoted(promoted map[chess.Square]bool) map[chess.Square]bool {
+	copied := make(map[chess.Square]bool, len(promoted))
+	for sq := range promoted {
+		copied[sq] = true
+	}
+	return copied
+}
+
+// capturedType returns the type of the piece that the move captures, which
+// is a pawn if the piece was promoted, or chess.NoPieceType if it doesn't
+// capture anything.
+func (p *variantPosition) capturedType(move *chess.Move) chess.PieceType {
+	switch {
+	case move.HasTag(chess.EnPassant):
+		return chess.Pawn
+	case !move.HasTag(chess.Capture):
+		return chess.NoPieceType
+	case p.promoted[move.S2()]:
+		return chess.Pawn
+	}
+	return p.position.Board().Piece(move.S2()).Type()
+}
+
+// pocketsAfter returns the pockets and promoted pieces after the ordinary
+// move. A captured piece goes to the pocket of the side that captured it,
+// as a pawn if it was promoted.
+func (p *variantPosition) pocketsAfter(move *chess.Move) (map[chess.Piece]int, map[chess.Square]bool) {
+	pockets, promoted := copyPockets(p.pockets), copyPromoted(p.promoted)
+	if captured := p.capturedType(move); captured != chess.NoPieceType {
+		pockets[chess.NewPiece(captured, p.position.Turn())]++
+	}
+	delete(promoted, move.S2())
+	if promoted[move.S1()] {
+		delete(promoted, move.S1())
+		promoted[move.S2()] = true
+	}
+	if move.Promo() != chess.NoPieceType {
+		promoted[move.S2()] = true
+	}
+	return pockets, promoted
+}
+
+// dropMoves returns the legal drops of the side to move. Pawns can't be
+// dropped on the first or last rank, and when in check only the drops that
+// block it are legal.
+func (p *variantPosition) dropMoves() []*dropMove {
+	if p.pockets == nil {
+		return nil
+	}
+	turn := p.position.Turn()
+	board := p.position.Board()
+	check := inCheck(p.position)
+	king := chess.NoSquare
+	for sq, piece := range board.SquareMap() {
+		if piece == chess.NewPiece(chess.King, turn) {
+			king = sq
+		}
+	}
+
+	drops := make([]*dropMove, 0)
+	for _, pieceType := range pocketPieceTypes {
+		piece := chess.NewPiece(pieceType, turn)
+		if p.pockets[piece] == 0 {
+			continue
+		}
+		for sq := chess.A1; sq <= chess.H8; sq++ {
+			if board.Piece(sq) != chess.NoPiece {
+				continue
+			}
+			if pieceType == chess.Pawn && (sq.Rank() == chess.Rank1 || sq.Rank() == chess.Rank8) {
+				continue
+			}
+			if check {
+				squares := board.SquareMap()
+				squares[sq] = piece
+				if squareAttacked(chess.NewBoard(squares), king, turn.Other()) {
+					continue
+				}
+			}
+			drops = append(drops, &dropMove{piece: piece, square: sq})
+		}
+	}
+	return drops
+}
+
+// playDrop returns the position after the drop.
+func (p *variantPosition) playDrop(drop *dropMove) *variantPosition {
+	squares := p.position.Board().SquareMap()
+	squares[drop.square] = drop.piece
+	next := p.successor(squares)
+	next.pockets[drop.piece]--
+	if next.pockets[drop.piece] == 0 {
+		delete(next.pockets, drop.piece)
+	}
+	return next
+}
+
+// dropPieceType returns the piece type of the letter of a drop, which is
+// left out for pawns.
+func dropPieceType(letter string) chess.PieceType {
+	for _, t := range pocketPieceTypes {
+		if letter != "" && t.String() == strings.ToLower(letter) {
+			return t
+		}
+	}
+	return chess.Pawn
+}
+
+// parseDrop finds the legal drop of the piece, given by its letter or
+// nothing for a pawn, on the square.
+func (p *variantPosition) parseDrop(letter, square string, moves []variantMove) (variantMove, error) {
+	pieceType := dropPieceType(letter)
+	sq := squareFromName(square)
+	for _, move := range moves {
+		if move.drop != nil && move.drop.piece.Type() == pieceType && move.drop.square == sq {
+			return move, nil
+		}
+	}
+
+	piece := chess.NewPiece(pieceType, p.position.Turn())
+	if p.pockets == nil {
+		return variantMove{}, fmt.Errorf("pieces can't be dropped in this variant")
+	} else if p.pockets[piece] == 0 {
+		return variantMove{}, fmt.Errorf("there is no %s in your pocket", pieceTypeNames[pieceType])
+	}
+	return variantMove{}, fmt.Errorf("can't drop a %s on %s", pieceTypeNames[pieceType], square)
+}
+
+// Pockets returns the piece types in each side's pocket after the number of
+// plies, from least to most valuable, or false if the variant has no drops.
+func (g *VariantGame) Pockets(ply int) (white, black []chess.PieceType, ok bool) {
+	pockets := g.positions[ply].pockets
+	if pockets == nil {
+		return nil, nil, false
+	}
+	white, black = []chess.PieceType{}, []chess.PieceType{}
+	for i := len(pocketPieceTypes) - 1; i >= 0; i-- {
+		pieceType := pocketPieceTypes[i]
+		for n := 0; n < pockets[chess.NewPiece(pieceType, chess.White)]; n++ {
+			white = append(white, pieceType)
+		}
+		for n := 0; n < pockets[chess.NewPiece(pieceType, chess.Black)]; n++ {
+			black = append(black, pieceType)
+		}
+	}
+	return white, black, true
+}
+
+// PocketString returns the current pockets as they are written in a FEN, or
+// an empty string if the variant has no drops.
+func (g *VariantGame) PocketString() string {
+	return pocketString(g.current().pockets)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strconv"
+
+	"github.com/notnil/chess"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	evalBarWidth = 32
+
+	evalGraphWidth   = 600
+	evalGraphHeight  = 240
+	evalGraphPadding = 24
+)
+
+var (
+	evalWhite    = color.RGBA{240, 240, 240, 255}
+	evalBlack    = color.RGBA{64, 64, 64, 255}
+	evalGrey     = color.RGBA{128, 128, 128, 255}
+	evalLine     = color.RGBA{32, 32, 32, 255}
+	evalArea     = color.RGBA{200, 200, 200, 255}
+	evalBlunder  = color.RGBA{219, 48, 48, 255}
+	evalAxisText = color.RGBA{85, 85, 85, 255}
+)
+
+func fillRect(img draw.Image, rect image.Rectangle, c color.Color) {
+	draw.Draw(img, rect, image.NewUniform(c), image.Point{}, draw.Src)
+}
+
+func drawText(img draw.Image, x, y int, text string, c color.Color) {
+	drawer := font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(c),
+		Face: basicfont.Face7x13,
+		Dot:  fixed.P(x, y),
+	}
+	drawer.DrawString(text)
+}
+
+func textWidth(text string) int {
+	return font.MeasureString(basicfont.Face7x13, text).Ceil()
+}
+
+// addEvalBar returns a copy of the PNG with an evaluation bar drawn to the
+// right of it. The bar spans the board, which starts boardTop pixels from the
+// top of the image. White's share of the bar is at the bottom when the board
+// is drawn from White's perspective.
+func addEvalBar(pngBytes []byte, evaluation Evaluation, orientation chess.Color, boardTop int) ([]byte, error) {
+	board, err := png.Decode(bytes.NewReader(pngBytes))
+	if err != nil {
+		return nil, err
+	}
+	bounds := board.Bounds()
+	img := image.NewRGBA(image.Rect(0, 0, bounds.Dx()+evalBarWidth, bounds.Dy()))
+	fillRect(img, img.Bounds(), color.White)
+	draw.Draw(img, bounds.Sub(bounds.Min), board, bounds.Min, draw.Src)
+
+	top, bottom := boardTop, boardTop+boardSize
+	bar := image.Rect(bounds.Dx(), top, bounds.Dx()+evalBarWidth, bottom)
+	bottomColor, topColor := evalWhite, evalBlack
+	share := (evaluation.Score() + 1) / 2 // White's share of the bar
+	if orientation == chess.Black {
+		bottomColor, topColor = evalBlack, evalWhite
+		share = 1 - share
+	}
+	split := bottom - int(share*float64(boardSize))
+	fillRect(img, image.Rect(bar.Min.X, top, bar.Max.X, split), topColor)
+	fillRect(img, image.Rect(bar.Min.X, split, bar.Max.X, bottom), bottomColor)
+	fillRect(img, image.Rect(bar.Min.X, top+boardSize/2, bar.Max.X, top+boardSize/2+1), evalGrey)
+
+	// Label the bar at the end of the side that is ahead.
+	label := evaluation.String()
+	if evaluation.Outcome == chess.Draw {
+		label = "=" // 1/2-1/2 doesn't fit
+	}
+	labelX := bar.Min.X + (evalBarWidth-textWidth(label))/2
+	if evaluation.Score() >= 0 == (orientation == chess.White) {
+		drawText(img, labelX, bottom-4, label, evalGrey)
+	} else {
+		drawText(img, labelX, top+13, label, evalGrey)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renderEvaluationGraph draws the evaluation after every ply of a game as a
+// line chart, with blunders marked in red. The first evaluation is of the
+// starting position, in which firstToMove is to move.
+func renderEvaluationGraph(evaluations []Evaluation, firstToMove chess.Color) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, evalGraphWidth, evalGraphHeight))
+	fillRect(img, img.Bounds(), color.White)
+
+	left, right := evalGraphPadding, evalGraphWidth-evalGraphPadding/2
+	top, bottom := evalGraphPadding/2, evalGraphHeight-evalGraphPadding
+	middle := (top + bottom) / 2
+	point := func(ply int) image.Point {
+		x := left
+		if len(evaluations) > 1 {
+			x += ply * (right - left) / (len(evaluations) - 1)
+		}
+		y := middle - int(evaluations[ply].Score()*float64(middle-top))
+		return image.Pt(x, y)
+	}
+
+	// Shade the area between the curve and the zero line.
+	for ply := 0; ply+1 < len(evaluations); ply++ {
+		from, to := point(ply), point(ply+1)
+		for x := from.X; x <= to.X; x++ {
+			y := from.Y
+			if to.X != from.X {
+				y += (to.Y - from.Y) * (x - from.X) / (to.X - from.X)
+			}
+			if y < middle {
+				fillRect(img, image.Rect(x, y, x+1, middle), evalArea)
+			} else {
+				fillRect(img, image.Rect(x, middle, x+1, y+1), evalArea)
+			}
+		}
+	}
+
+	fillRect(img, image.Rect(left, middle, right, middle+1), evalGrey)
+	fillRect(img, image.Rect(left, top, left+1, bottom), evalGrey)
+	drawText(img, 2, top+10, "+", evalAxisText)
+	drawText(img, 2, middle+4, "0", evalAxisText)
+	drawText(img, 2, bottom, "-", evalAxisText)
+
+	for ply := 0; ply+1 < len(evaluations); ply++ {
+		drawLine(img, point(ply), point(ply+1), evalLine)
+	}
+
+	// Mark the blunders, alternating the mover from the first to move.
+	mover := firstToMove
+	for ply := 1; ply < len(evaluations); ply++ {
+		if isBlunder(evaluations[ply-1], evaluations[ply], mover) {
+			fillCircle(img, point(ply), 4, evalBlunder)
+		}
+		mover = mover.Other()
+	}
+
+	// Label the x axis with full move numbers.
+	plies := len(evaluations) - 1
+	step := 10
+	for plies/step > 8 {
+		step *= 2
+	}
+	for move := step; move*2 <= plies; move += step {
+		x := point(move*2).X - textWidth(strconv.Itoa(move))/2
+		drawText(img, x, evalGraphHeight-6, strconv.Itoa(move), evalAxisText)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// drawLine draws a two pixel wide line between the points.
+func drawLine(img draw.Image, from, to image.Point, c color.Color) {
+	dx, dy := abs(to.X-from.X), -abs(to.Y-from.Y)
+	sx, sy := 1, 1
+	if from.X > to.X {
+		sx = -1
+	}
+	if from.Y > to.Y {
+		sy = -1
+	}
+	err := dx + dy
+	x, y := from.X, from.Y
+	for {
+		fillRect(img, image.Rect(x, y, x+2, y+2), c)
+		if x == to.X && y == to.Y {
+			return
+		}
+		e2 := 2 * err
+		if e2 >= dy {
+			err += dy
+			x += sx
+		}
+		if e2 <= dx {
+			err += dx
+			y += sy
+		}
+	}
+}
+
+func fillCircle(img draw.Image, center image.Point, radius int, c color.Color) {
+	for y := -radius; y <= radius; y++ {
+		for x := -radius; x <= radius; x++ {
+			if x*x+y*y <= radius*radius {
+				img.Set(center.X+x, center.Y+y, c)
+			}
+		}
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
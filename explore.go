@@ -0,0 +1,442 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/notnil/chess"
+	log "github.com/sirupsen/logrus"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+
+	"github.com/nevarro-space/matrix-chessbot/store"
+)
+
+// explorationLock serialises the moves played in analysis threads so that
+// two quick moves don't overwrite each other's variations.
+var explorationLock sync.Mutex
+
+// variationNode is a move in a variation tree. The first child continues the
+// main line and any others are variations.
+type variationNode struct {
+	Move     string           `json:"move,omitempty"`
+	Children []*variationNode `json:"children,omitempty"`
+}
+
+// variationTree is the moves tried out in an analysis thread, starting from
+// the position in FEN of the variant.
+type variationTree struct {
+	Title   string           `json:"title"`
+	Variant string           `json:"variant"`
+	FEN     string           `json:"fen"`
+	Tags    []*chess.TagPair `json:"tags,omitempty"`
+	Root    *variationNode   `json:"root"`
+}
+
+// newVariationTree returns a tree whose main line is the moves of the game.
+func newVariationTree(title string, game Game) *variationTree {
+	tree := &variationTree{
+		Title:   title,
+		Variant: gameVariant(game),
+		FEN:     positionFEN(game, 0),
+		Tags:    game.TagPairs(),
+		Root:    &variationNode{},
+	}
+	node := tree.Root
+	for i := range game.Moves() {
+		child := &variationNode{Move: moveSAN(game, i)}
+		node.Children = append(node.Children, child)
+		node = child
+	}
+	return tree
+}
+
+// newExplorationGame starts a game of the variant from the position.
+func newExplorationGame(variant, fen string) (Game, error) {
+	if variant == VariantStandard {
+		return parseFEN(fen)
+	}
+	return NewVariantGame(lookupVariant(variant), fen)
+}
+
+// parseVariationPath parses a path through a variation tree, which is the
+// index of the child taken at each move, separated by dots.
+func parseVariationPath(s string) ([]int, error) {
+	path := make([]int, 0)
+	if s == "" {
+		return path, nil
+	}
+	for _, part := range strings.Split(s, ".") {
+		i, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, i)
+	}
+	return path, nil
+}
+
+func formatVariationPath(path []int) string {
+	parts := make([]string, 0, len(path))
+	for _, i := range path {
+		parts = append(parts, strconv.Itoa(i))
+	}
+	return strings.Join(parts, ".")
+}
+
+// mainlinePath returns the path to the end of the main line.
+func (t *variationTree) mainlinePath() []int {
+	path := make([]int, 0)
+	for node := t.Root; len(node.Children) > 0; node = node.Children[0] {
+		path = append(path, 0)
+	}
+	return path
+}
+
+// node returns the node at the end of the path.
+func (t *variationTree) node(path []int) *variationNode {
+	node := t.Root
+	for _, i := range path {
+		node = node.Children[i]
+	}
+	return node
+}
+
+// game plays the moves along the path from the starting position.
+func (t *variationTree) game(path []int) (Game, error) {
+	game, err := newExplorationGame(t.Variant, t.FEN)
+	if err != nil {
+		return nil, err
+	}
+	node := t.Root
+	for _, i := range path {
+		if i < 0 || i >= len(node.Children) {
+			return nil, fmt.Errorf("there is no variation %d", i+1)
+		}
+		node = node.Children[i]
+		if err := game.MoveStr(node.Move); err != nil {
+			return nil, err
+		}
+	}
+	return game, nil
+}
+
+// pgn writes the tree as a PGN, with the variations as RAVs.
+func (t *variationTree) pgn() (string, error) {
+	start, err := newExplorationGame(t.Variant, t.FEN)
+	if err != nil {
+		return "", err
+	}
+	var pgn strings.Builder
+	hasFEN := false
+	for _, tag := range t.Tags {
+		if tag.Key != "Result" {
+			fmt.Fprintf(&pgn, "[%s \"%s\"]\n", tag.Key, tag.Value)
+		}
+		hasFEN = hasFEN || tag.Key == "FEN"
+	}
+	if !hasFEN && t.FEN != chess.StartingPosition().String() {
+		fmt.Fprintf(&pgn, "[SetUp \"1\"]\n[FEN \"%s\"]\n", t.FEN)
+	}
+	pgn.WriteString("[Result \"*\"]\n\n")
+	position := start.Position()
+	tokens := variationTokens(t.Root, moveNumber(position), position.Turn(), true)
+	pgn.WriteString(strings.Join(append(tokens, "*"), " "))
+	return pgn.String(), nil
+}
+
+// variationTokens returns the moves after the node: the main line move, then
+// the alternatives to it in parentheses, then the rest of the main line. The
+// move number is always written for White's moves, and for Black's moves at
+// the start of a line or after a variation.
+func variationTokens(node *variationNode, number int, turn chess.Color, showNumber bool) []string {
+	tokens := make([]string, 0)
+	for len(node.Children) > 0 {
+		nextNumber := number
+		if turn == chess.Black {
+			nextNumber++
+		}
+		tokens = append(tokens, moveToken(node.Children[0].Move, number, turn, showNumber))
+		for _, variation := range node.Children[1:] {
+			line := append([]string{moveToken(variation.Move, number, turn, true)}, variationTokens(variation, nextNumber, turn.Other(), false)...)
+			tokens = append(tokens, "("+strings.Join(line, " ")+")")
+		}
+		showNumber = len(node.Children) > 1
+		number, turn = nextNumber, turn.Other()
+		node = node.Children[0]
+	}
+	return tokens
+}
+
+// moveToken returns the move in SAN with its move number if it needs one.
+func moveToken(san string, number int, turn chess.Color, showNumber bool) string {
+	if turn == chess.White {
+		return fmt.Sprintf("%d. %s", number, san)
+	} else if showNumber {
+		return fmt.Sprintf("%d... %s", number, san)
+	}
+	return san
+}
+
+// explorationCaption describes the position at the end of the path.
+func explorationCaption(tree *variationTree, path []int, game Game) string {
+	var caption strings.Builder
+	fmt.Fprintf(&caption, "Exploring %s. ", tree.Title)
+	if len(path) == 0 {
+		fmt.Fprintf(&caption, "Starting position, %s to move.", colorName(game.Position().Turn()))
+	} else {
+		onMainline := true
+		for _, i := range path {
+			if i != 0 {
+				onMainline = false
+			}
+		}
+		line := "main line"
+		if !onMainline {
+			line = "variation"
+		}
+		fmt.Fprintf(&caption, "After %s (%s). %s", lastMoveString(game), line, gameStatus(game))
+		if len(game.Moves()) > 0 {
+			fmt.Fprintf(&caption, "\n%s", replayMoveList(game, len(game.Moves())))
+		}
+	}
+	if children := tree.node(path).Children; len(children) > 0 {
+		moves := make([]string, 0, len(children))
+		for _, child := range children {
+			moves = append(moves, child.Move)
+		}
+		fmt.Fprintf(&caption, "\nTried from here: %s", strings.Join(moves, ", "))
+	}
+	caption.WriteString("\nSend a move, back [n], branch [n], mainline or pgn in this thread. The real game isn't affected.")
+	return caption.String()
+}
+
+// explorationRender returns the render of the current position of the
+// analysis, with the engine evaluation if the engine understands the variant.
+func explorationRender(game Game) BoardRender {
+	render := BoardRender{
+		Board: game.Position().Board(),
+		Style: DefaultBoardStyle(),
+	}
+	if moves := game.Moves(); len(moves) > 0 {
+		last := moves[len(moves)-1]
+		render.Highlights = []chess.Square{last.S1(), last.S2()}
+	}
+	if variant, ok := game.(*VariantGame); !ok || variant.Variant().Evaluated() {
+		render.Evaluation = evaluatePosition(game.Position())
+	}
+	return render
+}
+
+// handleExploreCommand opens an analysis thread seeded from the current game,
+// an archived or imported game, or a FEN.
+func handleExploreCommand(event *mevent.Event, args []string) {
+	usage := "Usage: explore [game ID|fen <FEN>]"
+	args = nonEmpty(args)
+
+	var tree *variationTree
+	switch {
+	case len(args) > 0 && strings.ToLower(args[0]) == "fen":
+		fenStr := strings.Join(args[1:], " ")
+		game, err := parseFEN(fenStr)
+		if err != nil {
+			SendNotice(event.RoomID, fmt.Sprintf("Can't explore that FEN: %v.", err))
+			return
+		}
+		tree = newVariationTree("a position", game)
+	case len(args) <= 1:
+		gameID := ""
+		if len(args) == 1 {
+			gameID = args[0]
+		}
+		game, err := loadReplayGame(event.RoomID, gameID)
+		if err != nil {
+			SendNotice(event.RoomID, fmt.Sprintf("Can't explore the game: %v.", err))
+			return
+		}
+		if gameVariant(game) == VariantBughouse {
+			SendNotice(event.RoomID, "Bughouse games can't be explored, as the pieces come from the other board.")
+			return
+		}
+		tree = newVariationTree(gameTitle(game), game)
+	default:
+		SendNotice(event.RoomID, usage)
+		return
+	}
+
+	path := tree.mainlinePath()
+	game, err := tree.game(path)
+	if err != nil {
+		SendNotice(event.RoomID, fmt.Sprintf("Can't explore the game: %v.", err))
+		return
+	}
+	resp, err := SendBoardImage(event.RoomID, explorationRender(game), explorationCaption(tree, path, game), nil)
+	if err != nil {
+		log.Errorf("Failed to send exploration: %v", err)
+		return
+	}
+	encoded, err := json.Marshal(tree)
+	if err != nil {
+		log.Errorf("Failed to encode variation tree: %v", err)
+		return
+	}
+	exploration := store.Exploration{RoomID: event.RoomID, EventID: resp.EventID, Tree: string(encoded), Path: formatVariationPath(path)}
+	if err := App.explorationStore.SetExploration(&exploration); err != nil {
+		log.Errorf("Failed to save exploration: %v", err)
+	}
+}
+
+// handleExplorationMessage plays a move or runs a command sent in an
+// analysis thread, and replies in the thread with the new position. Messages
+// that are neither are ignored.
+func handleExplorationMessage(exploration *store.Exploration, command []string) {
+	explorationLock.Lock()
+	defer explorationLock.Unlock()
+
+	// Re-read the exploration now that we hold the lock, in case it moved.
+	if current := App.explorationStore.GetExploration(exploration.RoomID, exploration.EventID); current != nil {
+		exploration = current
+	}
+	var tree variationTree
+	if err := json.Unmarshal([]byte(exploration.Tree), &tree); err != nil {
+		log.Errorf("Failed to parse variation tree %s: %v", exploration.EventID, err)
+		return
+	}
+	path, err := parseVariationPath(exploration.Path)
+	if err != nil {
+		log.Errorf("Failed to parse variation path %s: %v", exploration.EventID, err)
+		return
+	}
+	if len(command) == 0 {
+		return
+	}
+	roomID, threadID := exploration.RoomID, exploration.EventID
+
+	count := func() (int, bool) {
+		if len(command) == 1 {
+			return 1, true
+		}
+		n, err := strconv.Atoi(command[1])
+		return n, err == nil && n > 0 && len(command) == 2
+	}
+	switch strings.ToLower(command[0]) {
+	case "back":
+		n, ok := count()
+		if !ok {
+			return
+		}
+		if n > len(path) {
+			n = len(path)
+		}
+		path = path[:len(path)-n]
+
+	case "branch":
+		if len(path) == 0 {
+			sendThreadNotice(roomID, threadID, "There is no move to branch from yet.")
+			return
+		}
+		parent := tree.node(path[:len(path)-1])
+		if len(command) == 1 {
+			alternatives := make([]string, 0, len(parent.Children))
+			for i, child := range parent.Children {
+				alternatives = append(alternatives, fmt.Sprintf("%d. %s", i+1, child.Move))
+			}
+			sendThreadNotice(roomID, threadID, fmt.Sprintf("Moves tried here: %s. Send branch <number> to switch to one, or play another move after back.", strings.Join(alternatives, ", ")))
+			return
+		}
+		n, ok := count()
+		if !ok || n > len(parent.Children) {
+			sendThreadNotice(roomID, threadID, fmt.Sprintf("There are %d moves to branch to here.", len(parent.Children)))
+			return
+		}
+		path[len(path)-1] = n - 1
+
+	case "mainline":
+		// Go back to where the current line left the main line, or to the end
+		// of the main line if it's already on it.
+		left := -1
+		for i, child := range path {
+			if child != 0 {
+				left = i
+				break
+			}
+		}
+		if left < 0 {
+			path = tree.mainlinePath()
+		} else {
+			path = path[:left]
+		}
+
+	case "pgn":
+		pgn, err := tree.pgn()
+		if err != nil {
+			log.Errorf("Failed to export variation tree %s: %v", exploration.EventID, err)
+			return
+		}
+		content, err := uploadFile([]byte(pgn+"\n"), "application/x-chess-pgn", "analysis.pgn")
+		if err != nil {
+			log.Errorf("Failed to upload variation tree %s: %v", exploration.EventID, err)
+			return
+		}
+		content.SetRelatesTo(&mevent.RelatesTo{Type: mevent.RelationType("m.thread"), EventID: threadID})
+		SendMessage(roomID, content)
+		return
+
+	default:
+		game, err := tree.game(path)
+		if err != nil {
+			log.Errorf("Failed to replay variation tree %s: %v", exploration.EventID, err)
+			return
+		}
+		if err := game.MoveStr(strings.Join(command, " ")); err != nil {
+			return
+		}
+		san := moveSAN(game, len(game.Moves())-1)
+		node := tree.node(path)
+		child := -1
+		for i, existing := range node.Children {
+			if existing.Move == san {
+				child = i
+			}
+		}
+		if child < 0 {
+			node.Children = append(node.Children, &variationNode{Move: san})
+			child = len(node.Children) - 1
+		}
+		path = append(path, child)
+	}
+
+	game, err := tree.game(path)
+	if err != nil {
+		log.Errorf("Failed to replay variation tree %s: %v", exploration.EventID, err)
+		return
+	}
+	if _, err := SendBoardImage(roomID, explorationRender(game), explorationCaption(&tree, path, game), &threadID); err != nil {
+		log.Errorf("Failed to send exploration: %v", err)
+		return
+	}
+	encoded, err := json.Marshal(&tree)
+	if err != nil {
+		log.Errorf("Failed to encode variation tree: %v", err)
+		return
+	}
+	exploration.Tree, exploration.Path = string(encoded), formatVariationPath(path)
+	if err := App.explorationStore.SetExploration(exploration); err != nil {
+		log.Errorf("Failed to save exploration: %v", err)
+	}
+}
+
+// sendThreadNotice sends a notice in the thread of the event.
+func sendThreadNotice(roomID mid.RoomID, threadID mid.EventID, body string) {
+	SendMessage(roomID, &mevent.MessageEventContent{
+		MsgType: mevent.MsgNotice,
+		Body:    body,
+		RelatesTo: &mevent.RelatesTo{
+			Type:    mevent.RelationType("m.thread"),
+			EventID: threadID,
+		},
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/notnil/chess"
+)
+
+// newNode returns a variation node whose first child continues the main line.
+func newNode(move string, children ...*variationNode) *variationNode {
+	return &variationNode{Move: move, Children: children}
+}
+
+func TestVariationTokens(t *testing.T) {
+	testCases := []struct {
+		name   string
+		root   *variationNode
+		number int
+		turn   chess.Color
+		want   string
+	}{
+		{"empty", newNode(""), 1, chess.White, ""},
+		{
+			"main line",
+			newNode("", newNode("e4", newNode("e5", newNode("Nf3")))),
+			1, chess.White,
+			"1. e4 e5 2. Nf3",
+		},
+		{
+			"variation on White's move",
+			newNode("", newNode("e4", newNode("e5")), newNode("d4")),
+			1, chess.White,
+			"1. e4 (1. d4) 1... e5",
+		},
+		{
+			"variation on Black's move",
+			newNode("", newNode("e4", newNode("e5", newNode("Nf3")), newNode("c5", newNode("Nf3")))),
+			1, chess.White,
+			"1. e4 e5 (1... c5 2. Nf3) 2. Nf3",
+		},
+		{
+			"nested variations",
+			newNode("", newNode("e4", newNode("e5"), newNode("c5", newNode("Nf3"), newNode("c3", newNode("d5")))), newNode("d4")),
+			1, chess.White,
+			"1. e4 (1. d4) 1... e5 (1... c5 2. Nf3 (2. c3 d5))",
+		},
+		{
+			"several variations",
+			newNode("", newNode("e4", newNode("e5"), newNode("c5"), newNode("e6"))),
+			1, chess.White,
+			"1. e4 e5 (1... c5) (1... e6)",
+		},
+		{
+			"Black to move",
+			newNode("", newNode("Nf6", newNode("Nc3")), newNode("d5")),
+			12, chess.Black,
+			"12... Nf6 (12... d5) 13. Nc3",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := strings.Join(variationTokens(tc.root, tc.number, tc.turn, true), " ")
+			if got != tc.want {
+				t.Errorf("variationTokens() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestVariationTreePGN(t *testing.T) {
+	tree := &variationTree{
+		Variant: VariantStandard,
+		FEN:     chess.StartingPosition().String(),
+		Tags:    []*chess.TagPair{{Key: "White", Value: "Alice"}, {Key: "Result", Value: "1-0"}},
+		Root:    newNode("", newNode("e4", newNode("e5"), newNode("c5"))),
+	}
+	pgn, err := tree.pgn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[White \"Alice\"]\n[Result \"*\"]\n\n1. e4 e5 (1... c5) *"
+	if pgn != want {
+		t.Errorf("pgn() = %q, want %q", pgn, want)
+	}
+	if _, err := chess.PGN(strings.NewReader(pgn)); err != nil {
+		t.Errorf("the PGN doesn't parse: %v", err)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/notnil/chess"
+	log "github.com/sirupsen/logrus"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// fenRegex matches anything that looks like a FEN or an EPD, including
+// invalid ones, so that the bot can explain what is wrong with them. The
+// board must have eight ranks, and the move counters are optional.
+var fenRegex = regexp.MustCompile(`[pnbrqkPNBRQK1-9]+(?:/[pnbrqkPNBRQK1-9]+){7}\s+[wb]\s+\S+\s+\S+(?:\s+\d+\s+\d+)?`)
+
+// analysisURLRegex matches links to the lichess and chess.com analysis
+// boards, which have the FEN in the URL.
+var analysisURLRegex = regexp.MustCompile(`https?://(?:www\.)?(?:lichess\.org|chess\.com)/[^\s"<>]+`)
+
+// findFENs returns the FENs in the message, up to maxGridPositions of them.
+// If the formatted body has FENs in code blocks, only those are used, as the
+// plain body repeats them. Otherwise, the FENs in analysis links come first,
+// followed by the ones in the plain body.
+func findFENs(content *mevent.MessageEventContent) []string {
+	fens := make([]string, 0)
+	if content.Format == mevent.FormatHTML {
+		for _, match := range codeBlockRegex.FindAllStringSubmatch(content.FormattedBody, -1) {
+			fens = append(fens, fenRegex.FindAllString(html.UnescapeString(match[1]), -1)...)
+		}
+	}
+	if len(fens) == 0 {
+		for _, link := range analysisURLRegex.FindAllString(content.Body, -1) {
+			if fen := fenFromAnalysisURL(link); fen != "" {
+				fens = append(fens, fen)
+			}
+		}
+		fens = append(fens, fenRegex.FindAllString(content.Body, -1)...)
+	}
+
+	unique := make([]string, 0, len(fens))
+	seen := map[string]bool{}
+	for _, fen := range fens {
+		fen = strings.Join(strings.Fields(fen), " ")
+		if !seen[fen] && len(unique) < maxGridPositions {
+			seen[fen] = true
+			unique = append(unique, fen)
+		}
+	}
+	return unique
+}
+
+// fenFromAnalysisURL extracts the FEN from a lichess analysis or editor link
+// such as https://lichess.org/analysis/<FEN with underscores>, or a chess.com
+// analysis link such as https://www.chess.com/analysis?fen=<FEN>.
+func fenFromAnalysisURL(link string) string {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	if fen := parsed.Query().Get("fen"); fen != "" {
+		return fenRegex.FindString(fen)
+	}
+	if !strings.HasSuffix(parsed.Host, "lichess.org") {
+		return ""
+	}
+	path := strings.TrimPrefix(parsed.Path, "/")
+	for _, prefix := range []string{"analysis/", "editor/"} {
+		if strings.HasPrefix(path, prefix) {
+			path = strings.TrimPrefix(strings.TrimPrefix(path, prefix), "standard/")
+			return fenRegex.FindString(strings.ReplaceAll(path, "_", " "))
+		}
+	}
+	return ""
+}
+
+// castlingPieceNames names the pieces that castling rights depend on.
+var castlingPieceNames = map[string]string{"K": "white king", "R": "white rook", "k": "black king", "r": "black rook"}
+
+// validateFEN checks that the FEN describes a legal position and returns it
+// with the move counters added if they were missing. The error explains what
+// is wrong with the FEN.
+func validateFEN(fen string) (string, error) {
+	fields := strings.Fields(fen)
+	if len(fields) == 4 {
+		// An EPD, which doesn't have the move counters.
+		fields = append(fields, "0", "1")
+	}
+	if len(fields) != 6 {
+		return "", fmt.Errorf("a FEN has six fields, but this has %d", len(fields))
+	}
+	placement, turn, castling, enPassant := fields[0], fields[1], fields[2], fields[3]
+
+	// Checking the number of ranks first keeps the squares below on the
+	// board.
+	ranks := strings.Split(placement, "/")
+	if len(ranks) != 8 {
+		return "", fmt.Errorf("a board has 8 ranks, but this has %d", len(ranks))
+	}
+
+	board := map[chess.Square]string{}
+	kings := map[string]int{}
+	for i, rank := range ranks {
+		file := 0
+		for _, r := range rank {
+			if r >= '1' && r <= '9' {
+				file += int(r - '0')
+				continue
+			}
+			if file < 8 {
+				board[chess.NewSquare(chess.File(file), chess.Rank(7-i))] = string(r)
+			}
+			if r == 'K' || r == 'k' {
+				kings[string(r)]++
+			}
+			if (r == 'P' || r == 'p') && (i == 0 || i == 7) {
+				return "", fmt.Errorf("there is a pawn on rank %d", 8-i)
+			}
+			file++
+		}
+		if file != 8 {
+			return "", fmt.Errorf("rank %d has %d squares instead of 8", 8-i, file)
+		}
+	}
+	for _, king := range []struct{ piece, name string }{{"K", "white"}, {"k", "black"}} {
+		switch kings[king.piece] {
+		case 0:
+			return "", fmt.Errorf("there is no %s king", king.name)
+		case 1:
+		default:
+			return "", fmt.Errorf("there are %d %s kings", kings[king.piece], king.name)
+		}
+	}
+
+	if turn != "w" && turn != "b" {
+		return "", fmt.Errorf("the side to move must be w or b, not %s", turn)
+	}
+
+	if castling != "-" {
+		required := map[rune][]struct {
+			square string
+			piece  string
+		}{
+			'K': {{"e1", "K"}, {"h1", "R"}},
+			'Q': {{"e1", "K"}, {"a1", "R"}},
+			'k': {{"e8", "k"}, {"h8", "r"}},
+			'q': {{"e8", "k"}, {"a8", "r"}},
+		}
+		seen := map[rune]bool{}
+		for _, right := range castling {
+			pieces, ok := required[right]
+			if !ok || seen[right] {
+				return "", fmt.Errorf("the castling field %s is invalid", castling)
+			}
+			seen[right] = true
+			for _, p := range pieces {
+				if board[squareFromName(p.square)] != p.piece {
+					return "", fmt.Errorf("the castling field allows %c, but there is no %s on %s", right, castlingPieceNames[p.piece], p.square)
+				}
+			}
+		}
+	}
+
+	if enPassant != "-" {
+		if len(enPassant) != 2 || enPassant[0] < 'a' || enPassant[0] > 'h' {
+			return "", fmt.Errorf("the en passant square %s is invalid", enPassant)
+		}
+		if turn == "w" && enPassant[1] != '6' {
+			return "", fmt.Errorf("%s can't be the en passant square when white is to move", enPassant)
+		}
+		if turn == "b" && enPassant[1] != '3' {
+			return "", fmt.Errorf("%s can't be the en passant square when black is to move", enPassant)
+		}
+	}
+
+	if n, err := strconv.Atoi(fields[4]); err != nil || n < 0 {
+		return "", fmt.Errorf("the halfmove clock %s is invalid", fields[4])
+	}
+	if n, err := strconv.Atoi(fields[5]); err != nil || n < 1 {
+		return "", fmt.Errorf("the move number %s is invalid", fields[5])
+	}
+
+	// The side that isn't to move can't be in check, since its last move
+	// would have had to leave its king attacked.
+	normalized := strings.Join(fields, " ")
+	var position chess.Position
+	if err := position.UnmarshalText([]byte(normalized)); err != nil {
+		return "", err
+	}
+	notToMove := position.Turn().Other()
+	for sq, piece := range position.Board().SquareMap() {
+		if piece == chess.NewPiece(chess.King, notToMove) && squareAttacked(position.Board(), sq, position.Turn()) {
+			return "", fmt.Errorf("the %s king is in check when %s is to move", strings.ToLower(colorName(notToMove)), strings.ToLower(colorName(position.Turn())))
+		}
+	}
+
+	return normalized, nil
+}
+
+// squareFromName returns the square with the given name, such as "e4".
+func squareFromName(name string) chess.Square {
+	return chess.NewSquare(chess.File(name[0]-'a'), chess.Rank(name[1]-'1'))
+}
+
+// sendFENNotice replies in the thread of the message with a notice, and
+// tracks it in place of a board image so that edits replace it.
+func sendFENNotice(roomID mid.RoomID, messageEventID mid.EventID, body string) {
+	resp, err := SendMessage(roomID, &mevent.MessageEventContent{
+		MsgType: mevent.MsgNotice,
+		Body:    body,
+		RelatesTo: &mevent.RelatesTo{
+			Type:    mevent.RelationType("m.thread"),
+			EventID: messageEventID,
+		},
+	})
+	if err == nil {
+		App.fenImageStore.SetEventID(roomID, messageEventID, resp.EventID)
+	}
+}
+
+// parseFEN validates the FEN and returns the game starting from it.
+func parseFEN(fenStr string) (*chess.Game, error) {
+	normalized, err := validateFEN(fenStr)
+	if err != nil {
+		return nil, err
+	}
+	fen, err := chess.FEN(normalized)
+	if err != nil {
+		return nil, err
+	}
+	return chess.NewGame(fen), nil
+}
+
+// sendFENPositions replies in the thread of the message with the positions.
+// A single position is sent as a board image, and several positions are sent
+// as a grid of boards in one image.
+func sendFENPositions(roomID mid.RoomID, messageEventID mid.EventID, fens []string) {
+	if len(fens) == 1 {
+		sendFENPosition(roomID, messageEventID, fens[0])
+		return
+	}
+
+	renders := make([]BoardRender, 0, len(fens))
+	labels := make([]string, 0, len(fens))
+	lines := make([]string, 0, len(fens))
+	for i, fenStr := range fens {
+		game, err := parseFEN(fenStr)
+		if err != nil {
+			log.Debugf("Invalid FEN (%s): %v", fenStr, err)
+			lines = append(lines, fmt.Sprintf("%d. That looks like a FEN, but it isn't valid: %v.", i+1, err))
+			continue
+		}
+		position := game.Position()
+		renders = append(renders, BoardRender{Board: position.Board(), Style: DefaultBoardStyle()})
+		labels = append(labels, fmt.Sprintf("%d. %s to move", i+1, colorName(position.Turn())))
+		lines = append(lines, fmt.Sprintf("%d. %s", i+1, describePosition(position, "")))
+	}
+	if len(renders) == 0 {
+		sendFENNotice(roomID, messageEventID, strings.Join(lines, "\n"))
+		return
+	}
+
+	grid, err := RenderBoardGrid(renders, labels)
+	if err != nil {
+		log.Errorf("Failed to render board grid: %v", err)
+		return
+	}
+	uploaded, err := uploadImage(grid, "positions.png")
+	if err != nil {
+		log.Errorf("Failed to upload board grid: %v", err)
+		return
+	}
+	resp, err := SendImage(roomID, uploaded, strings.Join(lines, "\n"), &messageEventID)
+	if err != nil {
+		log.Errorf("Failed to send board grid: %v", err)
+		return
+	}
+	App.fenImageStore.SetEventID(roomID, messageEventID, resp.EventID)
+}
+
+// sendFENPosition replies in the thread of the message with the position, or
+// with the reason that the FEN is invalid.
+func sendFENPosition(roomID mid.RoomID, messageEventID mid.EventID, fenStr string) {
+	game, err := parseFEN(fenStr)
+	if err != nil {
+		log.Debugf("Invalid FEN (%s): %v", fenStr, err)
+		sendFENNotice(roomID, messageEventID, fmt.Sprintf("That looks like a FEN, but it isn't valid: %v.", err))
+		return
+	}
+
+	render := BoardRender{
+		Board:      game.Position().Board(),
+		Style:      DefaultBoardStyle(),
+		Evaluation: evaluatePosition(game.Position()),
+	}
+	sent, err := SendBoardImage(roomID, render, describePosition(game.Position(), ""), &messageEventID)
+	if err != nil {
+		log.Errorf("Failed to send board image: %v", err)
+		return
+	}
+	App.fenImageStore.SetEventID(roomID, messageEventID, sent.EventID)
+}
+
+var numberedLineRegex = regexp.MustCompile(`^(\d+)\. `)
+
+// fenForPlay returns the FEN of the numbered position in a message or a board
+// grid, or the only FEN in the message if number is 0.
+func fenForPlay(content *mevent.MessageEventContent, number int) (string, error) {
+	if number > 0 {
+		// The descriptions of grids number the positions, including the
+		// invalid ones, which the grid leaves out.
+		numbered := false
+		for _, line := range strings.Split(content.Body, "\n") {
+			match := numberedLineRegex.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+			numbered = true
+			if match[1] == strconv.Itoa(number) {
+				if fen := fenRegex.FindString(line); fen != "" {
+					return fen, nil
+				}
+				return "", fmt.Errorf("position %d isn't valid", number)
+			}
+		}
+		if fens := findFENs(content); !numbered && number <= len(fens) {
+			return fens[number-1], nil
+		}
+		return "", fmt.Errorf("there is no position %d in that message", number)
+	}
+
+	switch fens := findFENs(content); len(fens) {
+	case 0:
+		return "", fmt.Errorf("there is no FEN in that message")
+	case 1:
+		return fens[0], nil
+	default:
+		return "", fmt.Errorf("that message has %d positions, so say which one to play with `!chess play this <number>`", len(fens))
+	}
+}
+
+// handlePlayCommand starts a game from the FEN in the message that the
+// command replies to, which is either a message with a FEN or a board that
+// the bot rendered from one. In a thread, the thread root is used if the
+// command isn't a reply.
+func handlePlayCommand(event *mevent.Event, args []string) {
+	args = nonEmpty(args)
+	number := 0
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			args = nil
+		}
+		number = n
+	}
+	if len(args) < 1 || len(args) > 2 || strings.ToLower(args[0]) != "this" {
+		SendNotice(event.RoomID, "Usage: reply to a FEN or a board with `!chess play this [number]`")
+		return
+	}
+
+	content := event.Content.AsMessage()
+	target := content.GetReplyTo()
+	if relatesTo := content.RelatesTo; target == "" && relatesTo != nil && relatesTo.Type == mevent.RelationType("m.thread") {
+		target = relatesTo.EventID
+	}
+	if target == "" {
+		SendNotice(event.RoomID, "Reply to a FEN or a board with `!chess play this` to play from that position.")
+		return
+	}
+	original, err := fetchEvent(event.RoomID, target)
+	if err != nil {
+		log.Errorf("Failed to fetch %s: %v", target, err)
+		SendNotice(event.RoomID, "Failed to fetch the message being replied to.")
+		return
+	}
+	if original.Type != mevent.EventMessage {
+		SendNotice(event.RoomID, "That message doesn't have a position in it.")
+		return
+	}
+	fenStr, err := fenForPlay(original.Content.AsMessage(), number)
+	if err != nil {
+		SendNotice(event.RoomID, fmt.Sprintf("Can't play from that message: %v.", err))
+		return
+	}
+	startGameFromFEN(event.RoomID, fenStr, StateChessGameEventContent{GameID: newGameID(), TimeControl: "-"})
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestValidateFEN(t *testing.T) {
+	testCases := []struct {
+		name string
+		fen  string
+		want string
+		ok   bool
+	}{
+		{"starting position", "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1", "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1", true},
+		{"EPD", "4k3/8/8/8/8/8/8/4K3 b - -", "4k3/8/8/8/8/8/8/4K3 b - - 0 1", true},
+		{"side to move in check", "4k3/8/8/8/8/8/8/4K2r w - - 0 1", "4k3/8/8/8/8/8/8/4K2r w - - 0 1", true},
+		{"seven ranks", "4k3/8/8/8/8/8/4K3 w - - 0 1", "", false},
+		{"nine ranks", "4k3/8/8/8/8/8/8/8/4K3 w - - 0 1", "", false},
+		{"side not to move in check", "4k3/8/8/8/8/8/8/4K2r b - - 0 1", "", false},
+		{"kings side by side", "8/8/8/8/8/8/8/3kK3 w - - 0 1", "", false},
+		{"pawn on the back rank", "4k2P/8/8/8/8/8/8/4K3 w - - 0 1", "", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fen, err := validateFEN(tc.fen)
+			if (err == nil) != tc.ok || fen != tc.want {
+				t.Errorf("validateFEN(%q) = %q, %v, want %q, ok %v", tc.fen, fen, err, tc.want, tc.ok)
+			}
+		})
+	}
+}
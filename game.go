@@ -0,0 +1,571 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/notnil/chess"
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+
+	"github.com/nevarro-space/matrix-chessbot/store"
+)
+
+// Game is a game of standard chess, which *chess.Game and *StandardGame
+// implement, or of a variant, which *VariantGame implements.
+type Game interface {
+	Position() *chess.Position
+	Positions() []*chess.Position
+	Moves() []*chess.Move
+	Comments() [][]string
+	MoveStr(s string) error
+	Outcome() chess.Outcome
+	Method() chess.Method
+	EligibleDraws() []chess.Method
+	Draw(method chess.Method) error
+	AddTagPair(k, v string) bool
+	GetTagPair(k string) *chess.TagPair
+	RemoveTagPair(k string) bool
+	TagPairs() []*chess.TagPair
+	String() string
+}
+
+var variantTagPairRegex = regexp.MustCompile(`\[Variant\s+"([^"]*)"\]`)
+
+// parseGamePGN parses the PGN of a game, which is a game of a variant if it
+// has a Variant tag.
+func parseGamePGN(pgn string) (Game, error) {
+	if match := variantTagPairRegex.FindStringSubmatch(pgn); match != nil && match[1] != "Standard" {
+		return ParseVariantPGN(pgn)
+	}
+	return parseStandardPGN(pgn)
+}
+
+// moveSAN returns the move of the game with the index in SAN.
+func moveSAN(game Game, i int) string {
+	if variant, ok := game.(*VariantGame); ok {
+		return variant.SAN(i)
+	}
+	return chess.AlgebraicNotation{}.Encode(game.Positions()[i], game.Moves()[i])
+}
+
+// positionFEN returns the FEN of the position of the game after the number
+// of plies.
+func positionFEN(game Game, ply int) string {
+	if variant, ok := game.(*VariantGame); ok {
+		return variant.PositionFEN(ply)
+	}
+	return game.Positions()[ply].String()
+}
+
+// describeGamePosition describes the current position of the game and its
+// last move.
+func describeGamePosition(game Game) string {
+	positions := game.Positions()
+	return describeBoard(positionFEN(game, len(positions)-1), gameStatus(game), lastMoveString(game))
+}
+
+var StateChessGame = mevent.Type{Type: "space.nevarro.chess.game", Class: mevent.StateEventType}
+
+type StateChessGameEventContent struct {
+	GameID            string
+	PGN               string
+	BoardImageEventID mid.EventID
+
+	// The players are assigned when they make their first move.
+	White mid.UserID
+	Black mid.UserID
+
+	// Rated games count towards the players' ratings in the pool for the
+	// time control. TimeControl is in the PGN format, or "-" if there is
+	// none.
+	Rated       bool
+	TimeControl string
+
+	// Evaluations holds the engine evaluation of every position of the game,
+	// starting with the initial position. It is only kept up to date while an
+	// engine is configured.
+	Evaluations []Evaluation
+
+	// Variant is the PGN Variant tag of the game's variant, which decides the
+	// rules its PGN is played with. Pockets holds the pieces in hand in
+	// Crazyhouse and Bughouse games, written as in the FEN with White's
+	// pieces first. It is empty in other games.
+	Variant string
+	Pockets string
+
+	// Bughouse holds the second board of a Bughouse match, which is nil for
+	// other games.
+	Bughouse *BughouseBoard `json:",omitempty"`
+
+	// Flipped shows the board from Black's side. Reacting to the board with
+	// 🔄 flips it.
+	Flipped bool `json:",omitempty"`
+
+	// Vote holds the side that the room plays in a vote chess game, which is
+	// nil for other games.
+	Vote *VoteChess `json:",omitempty"`
+
+	// Offer holds the draw offer or takeback request that waits for an
+	// answer, which is nil if there is none.
+	Offer *Offer `json:",omitempty"`
+}
+
+// addEvaluation evaluates the current position of the game and appends it to
+// the evaluations, as long as every previous position has been evaluated too.
+func (c *StateChessGameEventContent) addEvaluation(game Game) {
+	if len(c.Evaluations) != len(game.Positions())-1 {
+		return
+	}
+	if variant, ok := game.(*VariantGame); ok && !variant.Variant().Evaluated() {
+		return
+	}
+	if evaluation := evaluatePosition(game.Position()); evaluation != nil {
+		c.Evaluations = append(c.Evaluations, *evaluation)
+	}
+}
+
+// currentEvaluation returns the evaluation of the current position of the
+// game, or nil if it hasn't been evaluated.
+func (c *StateChessGameEventContent) currentEvaluation(game Game) *Evaluation {
+	if len(c.Evaluations) != len(game.Positions()) {
+		return nil
+	}
+	return &c.Evaluations[len(c.Evaluations)-1]
+}
+
+// Player returns the user playing the given colour, if there is one yet.
+func (c *StateChessGameEventContent) Player(color chess.Color) mid.UserID {
+	if color == chess.White {
+		return c.White
+	}
+	return c.Black
+}
+
+// SetPlayer assigns the user to the given colour.
+func (c *StateChessGameEventContent) SetPlayer(color chess.Color, userID mid.UserID) {
+	if color == chess.White {
+		c.White = userID
+	} else {
+		c.Black = userID
+	}
+}
+
+// newGameID returns a short random ID that identifies a game in the archive.
+func newGameID() string {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return strings.ToLower(base32.StdEncoding.EncodeToString(b))
+}
+
+// saveGame saves the game to the room state and to the game archive. The
+// game state is updated with the game, so that a later save of the same
+// state doesn't undo the move.
+func saveGame(roomID mid.RoomID, game Game, gameState *StateChessGameEventContent) (resp *mautrix.RespSendEvent, err error) {
+	if gameState.GameID == "" {
+		gameState.GameID = newGameID()
+	}
+	archiveGame(roomID, game, gameState)
+	return App.client.SendStateEvent(roomID, StateChessGame, "", gameState)
+}
+
+// archiveGame updates the PGN, variant and pockets in the game state and
+// saves the game to the game archive.
+func archiveGame(roomID mid.RoomID, game Game, gameState *StateChessGameEventContent) {
+	archived := store.ArchivedGame{
+		ID:          gameState.GameID,
+		RoomID:      roomID,
+		White:       gameState.White,
+		Black:       gameState.Black,
+		TimeControl: gameState.TimeControl,
+		Rated:       gameState.Rated,
+		Result:      game.Outcome().String(),
+		StartedAt:   time.Now(),
+	}
+	// The players are only known once they have moved, and the opening and
+	// the result once the game is over, so the tags are only set when the
+	// game starts and ends rather than looking up names on every move.
+	// exportPGN brings them up to date in between.
+	if len(game.Moves()) == 0 || game.Outcome() != chess.NoOutcome {
+		setPGNTags(game, &archived, roomDisplayNames(roomID))
+	}
+	gameState.PGN = game.String()
+	gameState.Variant = gameVariant(game)
+	if variant, ok := game.(*VariantGame); ok {
+		gameState.Pockets = variant.PocketString()
+	}
+	archived.PGN = gameState.PGN
+	if game.Outcome() != chess.NoOutcome {
+		archived.EndedAt = time.Now()
+	}
+	if err := App.gameStore.SaveGame(&archived); err != nil {
+		log.Errorf("Failed to archive game %s: %v", gameState.GameID, err)
+	}
+}
+
+// abandonGame closes the archive records of the room's current game, or of
+// both games of its Bughouse match, if they are still being played. It is
+// called before a new game replaces them, so that they don't stay in the
+// archive as games in progress. Their result stays "*", with a Termination
+// tag to say that they were abandoned.
+func abandonGame(roomID mid.RoomID) {
+	gameState, err := getGameStateEvent(roomID)
+	if err != nil {
+		return
+	}
+	gameIDs := []string{gameState.GameID}
+	if gameState.Bughouse != nil {
+		gameIDs = append(gameIDs, gameState.Bughouse.GameID)
+	}
+	for _, gameID := range gameIDs {
+		archived := App.gameStore.GetGame(gameID)
+		if archived == nil || !archived.EndedAt.IsZero() {
+			continue
+		}
+		if game, err := parseGamePGN(archived.PGN); err == nil {
+			game.AddTagPair("Termination", "abandoned")
+			archived.PGN = game.String()
+		}
+		archived.EndedAt = time.Now()
+		if err := App.gameStore.SaveGame(archived); err != nil {
+			log.Errorf("Failed to archive abandoned game %s: %v", gameID, err)
+		}
+	}
+}
+
+// startGame sends the board of a new game and saves it as the game of the
+// room, replacing any previous game.
+func startGame(roomID mid.RoomID, game Game, gameState StateChessGameEventContent) {
+	gameState.addEvaluation(game)
+	render := gameBoardRender(roomID, &gameState, game)
+	boardImageEvent, err := SendBoardImage(roomID, render, describeGamePosition(game), nil)
+	if err != nil {
+		log.Errorf("Failed to send board image: %v", err)
+		return
+	}
+	gameState.BoardImageEventID = boardImageEvent.EventID
+	abandonGame(roomID)
+	if _, err := saveGame(roomID, game, &gameState); err != nil {
+		log.Errorf("Failed to save game %s: %v", gameState.GameID, err)
+	}
+}
+
+// handleNewCommand starts a new game of standard chess, of one of the
+// variants or from a FEN, a Bughouse match or a vote chess game. The number
+// of a Chess960 position must come straight after "960", the players of a
+// Bughouse match after "bughouse", and the side and opponent of a vote chess
+// game after "vote".
+func handleNewCommand(roomID mid.RoomID, args []string) {
+	usage := "Usage: new [rated|casual] [minutes+increment] [960 [position]|crazyhouse|threecheck|koth|bughouse <players>|vote <opponent>|fen <FEN>]"
+	gameState := StateChessGameEventContent{GameID: newGameID(), Rated: true, TimeControl: "-"}
+	ratedRequested := false
+	fenStr := ""
+	var variant Variant
+	chooseVariant := func(v Variant) bool {
+		if variant != nil {
+			SendNotice(roomID, "Choose only one variant.")
+			return false
+		}
+		variant = v
+		return true
+	}
+	chess960ID := -1
+options:
+	for i := 0; i < len(args); i++ {
+		option := strings.ToLower(args[i])
+		switch option {
+		case "":
+		case "rated":
+			gameState.Rated = true
+			ratedRequested = true
+		case "casual":
+			gameState.Rated = false
+		case "960", "chess960":
+			if !chooseVariant(chess960Variant{}) {
+				return
+			}
+			chess960ID = randomChess960ID()
+			if i+1 < len(args) {
+				if id, err := strconv.Atoi(args[i+1]); err == nil {
+					chess960ID = id
+					i++
+				}
+			}
+		case "vote":
+			if variant != nil {
+				SendNotice(roomID, "Vote chess games are standard chess, so they can't be played in a variant.")
+			} else if ratedRequested {
+				SendNotice(roomID, "Vote chess games can't be rated.")
+			} else {
+				handleNewVoteCommand(roomID, args[i+1:], gameState)
+			}
+			return
+		case "bughouse":
+			if variant != nil {
+				SendNotice(roomID, "Choose only one variant.")
+			} else if ratedRequested {
+				SendNotice(roomID, "Bughouse matches can't be rated.")
+			} else {
+				handleNewBughouseCommand(roomID, args[i+1:], gameState)
+			}
+			return
+		case "fen":
+			fenStr = strings.TrimSpace(strings.Join(args[i+1:], " "))
+			if fenStr == "" {
+				SendNotice(roomID, usage)
+				return
+			}
+			break options
+		default:
+			if v, ok := variants[option]; ok {
+				if !chooseVariant(v) {
+					return
+				}
+				continue
+			}
+			timeControl, ok := parseTimeControl(args[i])
+			if !ok {
+				SendNotice(roomID, fmt.Sprintf("Unknown option %s. %s", args[i], usage))
+				return
+			}
+			gameState.TimeControl = timeControl
+		}
+	}
+
+	switch {
+	case fenStr != "" && variant != nil:
+		SendNotice(roomID, "Games from a FEN are standard chess, so choose either a variant or a FEN, not both.")
+	case fenStr != "":
+		if ratedRequested {
+			SendNotice(roomID, "Games from a set-up position can't be rated.")
+			return
+		}
+		startGameFromFEN(roomID, fenStr, gameState)
+	case chess960ID >= 0:
+		game, err := newChess960Game(chess960ID)
+		if err != nil {
+			SendNotice(roomID, fmt.Sprintf("Can't start the game: %v.", err))
+			return
+		}
+		SendNotice(roomID, fmt.Sprintf("Chess960 position %d: %s.", chess960ID, chess960BackRank(chess960ID)))
+		startGame(roomID, game, gameState)
+	case variant != nil:
+		game, err := NewVariantGame(variant, variant.StartingFEN())
+		if err != nil {
+			SendNotice(roomID, fmt.Sprintf("Can't start the game: %v.", err))
+			return
+		}
+		startGame(roomID, game, gameState)
+	default:
+		startGame(roomID, chess.NewGame(), gameState)
+	}
+}
+
+// startGameFromFEN starts a casual game from the position, recording it in
+// the SetUp and FEN tags of the PGN. Games from set-up positions are never
+// rated.
+func startGameFromFEN(roomID mid.RoomID, fenStr string, gameState StateChessGameEventContent) {
+	game, err := parseFEN(fenStr)
+	if err != nil {
+		SendNotice(roomID, fmt.Sprintf("Can't start a game from that FEN: %v.", err))
+		return
+	}
+	if len(game.Position().ValidMoves()) == 0 {
+		SendNotice(roomID, "The game is already over in that position.")
+		return
+	}
+	game.AddTagPair("SetUp", "1")
+	game.AddTagPair("FEN", game.Position().String())
+	gameState.Rated = false
+	startGame(roomID, game, gameState)
+}
+
+// finishGame announces the rating changes and posts the evaluation graph once
+// the game is over.
+func finishGame(roomID mid.RoomID, gameState *StateChessGameEventContent, game Game) {
+	if summary := updateRatings(gameState, game.Outcome()); summary != "" {
+		SendNotice(roomID, summary)
+	}
+	sendEvaluationGraph(roomID, gameState, game)
+}
+
+// capturedPieces returns the piece types that each side has captured with the
+// moves, from least to most valuable. Each move is played from the position
+// with the same index.
+func capturedPieces(positions []*chess.Position, moves []*chess.Move) (byWhite, byBlack []chess.PieceType) {
+	for i, move := range moves {
+		var captured chess.PieceType
+		if move.HasTag(chess.EnPassant) {
+			captured = chess.Pawn
+		} else if move.HasTag(chess.Capture) {
+			captured = positions[i].Board().Piece(move.S2()).Type()
+		} else {
+			continue
+		}
+		if positions[i].Turn() == chess.White {
+			byWhite = append(byWhite, captured)
+		} else {
+			byBlack = append(byBlack, captured)
+		}
+	}
+	sortByValue(byWhite)
+	sortByValue(byBlack)
+	return byWhite, byBlack
+}
+
+// setVariantAnnotations shows the pockets and the checks given after the
+// number of plies in the margins, if the game's variant has them.
+func setVariantAnnotations(annotations *BoardAnnotations, game Game, ply int) {
+	if variant, ok := game.(*VariantGame); ok {
+		annotations.WhitePocket, annotations.BlackPocket, annotations.Pockets = variant.Pockets(ply)
+		annotations.WhiteChecks, annotations.BlackChecks, annotations.Checks = variant.Checks(ply)
+	}
+}
+
+// moveNumber returns the full move number of the position.
+func moveNumber(position *chess.Position) int {
+	fields := strings.Fields(position.String())
+	n, _ := strconv.Atoi(fields[len(fields)-1])
+	return n
+}
+
+// gameBoardRender returns the render of the current position of the game,
+// including the player margins.
+func gameBoardRender(roomID mid.RoomID, gameState *StateChessGameEventContent, game Game, highlights ...chess.Square) BoardRender {
+	annotations := BoardAnnotations{MoveNumber: moveNumber(game.Position())}
+	if gameState.White != "" {
+		annotations.WhiteName = getDisplayName(roomID, gameState.White)
+	}
+	if gameState.Black != "" {
+		annotations.BlackName = getDisplayName(roomID, gameState.Black)
+	}
+	annotations.CapturedByWhite, annotations.CapturedByBlack = capturedPieces(game.Positions(), game.Moves())
+	setVariantAnnotations(&annotations, game, len(game.Moves()))
+
+	style := DefaultBoardStyle()
+	if gameState.Flipped {
+		style.Orientation = chess.Black
+	}
+	return BoardRender{
+		Board:       game.Position().Board(),
+		Highlights:  highlights,
+		Style:       style,
+		Annotations: &annotations,
+		Evaluation:  gameState.currentEvaluation(game),
+	}
+}
+
+// lastMoveSquares returns the squares of the last move of the game, which are
+// highlighted on its board.
+func lastMoveSquares(game Game) []chess.Square {
+	moves := game.Moves()
+	if len(moves) == 0 {
+		return nil
+	}
+	last := moves[len(moves)-1]
+	return []chess.Square{last.S1(), last.S2()}
+}
+
+// flipBoard sends the board of the current game again from the other side,
+// if the event is its board image. The board stays flipped for the rest of
+// the game.
+func flipBoard(roomID mid.RoomID, eventID mid.EventID) {
+	gameState, err := getGameStateEvent(roomID)
+	if err != nil || gameState.BoardImageEventID != eventID {
+		return
+	}
+	gameState.Flipped = !gameState.Flipped
+
+	var resp mid.EventID
+	if gameState.Bughouse != nil {
+		games, err := loadBughouse(gameState)
+		if err != nil {
+			log.Errorf("Failed to load Bughouse match %s: %v", gameState.GameID, err)
+			return
+		}
+		resp, err = sendBughouseBoards(roomID, gameState, games, [2][]chess.Square{lastMoveSquares(games[0]), lastMoveSquares(games[1])})
+		if err != nil {
+			log.Errorf("Failed to send Bughouse boards: %v", err)
+			return
+		}
+	} else {
+		game, err := gameState.parseGame()
+		if err != nil {
+			log.Errorf("Failed to parse game %s: %v", gameState.GameID, err)
+			return
+		}
+		render := gameBoardRender(roomID, gameState, game, lastMoveSquares(game)...)
+		sent, err := SendBoardImage(roomID, render, describeGamePosition(game), nil)
+		if err != nil {
+			log.Errorf("Failed to send board image: %v", err)
+			return
+		}
+		resp = sent.EventID
+	}
+	App.client.RedactEvent(roomID, eventID)
+	gameState.BoardImageEventID = resp
+	if _, err := App.client.SendStateEvent(roomID, StateChessGame, "", gameState); err != nil {
+		log.Errorf("Failed to save game %s: %v", gameState.GameID, err)
+	}
+}
+
+// sendEvaluationGraph posts a graph of the evaluation over the whole game, if
+// every position of the game has been evaluated.
+func sendEvaluationGraph(roomID mid.RoomID, gameState *StateChessGameEventContent, game Game) {
+	if len(gameState.Evaluations) != len(game.Positions()) || len(game.Moves()) == 0 {
+		return
+	}
+	graph, err := renderEvaluationGraph(gameState.Evaluations, game.Positions()[0].Turn())
+	if err != nil {
+		log.Errorf("Failed to render evaluation graph: %v", err)
+		return
+	}
+	image, err := NewRenderedImage(graph)
+	if err != nil {
+		log.Errorf("Failed to render evaluation graph: %v", err)
+		return
+	}
+	uploaded, err := uploadImage(image, "evaluation.png")
+	if err != nil {
+		log.Errorf("Failed to upload evaluation graph: %v", err)
+		return
+	}
+	description := fmt.Sprintf("Evaluation graph for the game (%s)", game.Outcome())
+	if _, err := SendImage(roomID, uploaded, description, nil); err != nil {
+		log.Errorf("Failed to send evaluation graph: %v", err)
+	}
+}
+
+// lastMoveString returns the last move of the game in SAN prefixed with the
+// move number, for example "12... Nf6".
+func lastMoveString(game Game) string {
+	moves := game.Moves()
+	if len(moves) == 0 {
+		return ""
+	}
+	positions := game.Positions()
+	previous := positions[len(positions)-2]
+	san := annotatedSAN(game, len(moves)-1)
+	if previous.Turn() == chess.White {
+		return fmt.Sprintf("%d. %s", moveNumber(previous), san)
+	}
+	return fmt.Sprintf("%d... %s", moveNumber(previous), san)
+}
+
+func getGameStateEvent(roomID mid.RoomID) (*StateChessGameEventContent, error) {
+	var chessGame StateChessGameEventContent
+	err := App.client.StateEvent(roomID, StateChessGame, "", &chessGame)
+	if err != nil {
+		return nil, err
+	}
+	return &chessGame, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	mid "maunium.net/go/mautrix/id"
+)
+
+func TestNewGameAbandonsUnfinishedGame(t *testing.T) {
+	roomID := mid.RoomID("!room:test")
+	setUpTestApp(t)
+
+	handleNewCommand(roomID, nil)
+	replaced, err := getGameStateEvent(roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handleNewCommand(roomID, nil)
+
+	archived := App.gameStore.GetGame(replaced.GameID)
+	if archived == nil {
+		t.Fatalf("game %s isn't in the archive", replaced.GameID)
+	}
+	if archived.EndedAt.IsZero() {
+		t.Errorf("the replaced game hasn't ended")
+	}
+	if !strings.Contains(archived.PGN, `[Termination "abandoned"]`) {
+		t.Errorf("PGN %q doesn't say that the game was abandoned", archived.PGN)
+	}
+	current, err := getGameStateEvent(roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archived := App.gameStore.GetGame(current.GameID); archived == nil || !archived.EndedAt.IsZero() {
+		t.Errorf("the new game %+v should still be in progress", archived)
+	}
+}
@@ -3,10 +3,13 @@ module github.com/nevarro-space/matrix-chessbot
 go 1.16
 
 require (
+	github.com/ajstarks/svgo v0.0.0-20200320125537-f189e35d30ca
+	github.com/buckket/go-blurhash v1.1.0
 	github.com/mattn/go-sqlite3 v1.14.13
-	github.com/notnil/chess v1.7.1
+	github.com/notnil/chess v1.9.0
 	github.com/sethvargo/go-retry v0.1.0
 	github.com/sirupsen/logrus v1.8.1
+	golang.org/x/image v0.0.0-20220413100746-70e8d0d3baa9
 	gopkg.in/yaml.v2 v2.4.0
 	gopkg.in/yaml.v3 v3.0.0 // indirect
 	maunium.net/go/mautrix v0.11.0
@@ -6,15 +6,27 @@ import (
 	_ "strconv"
 	"time"
 
-	"github.com/notnil/chess"
 	"github.com/sethvargo/go-retry"
 	log "github.com/sirupsen/logrus"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
+
+	"github.com/nevarro-space/matrix-chessbot/store"
 )
 
+// getDisplayName returns the display name of the user in the room, falling
+// back to their user ID if they don't have one.
+func getDisplayName(roomID id.RoomID, userID id.UserID) string {
+	var member event.MemberEventContent
+	err := App.client.StateEvent(roomID, event.StateMember, userID.String(), &member)
+	if err != nil || member.Displayname == "" {
+		return userID.String()
+	}
+	return member.Displayname
+}
+
 func DoRetry(description string, fn func() (interface{}, error)) (interface{}, error) {
 	var err error
 	b, err := retry.NewFibonacci(1 * time.Second)
@@ -42,35 +54,39 @@ func DoRetry(description string, fn func() (interface{}, error)) (interface{}, e
 	return nil, err
 }
 
-func encryptMessageEventContent(roomID id.RoomID, eventContent *event.MessageEventContent) (event.Type, interface{}, error) {
+func encryptEventContent(roomID id.RoomID, eventType event.Type, eventContent interface{}, relatesTo *event.RelatesTo) (event.Type, interface{}, error) {
 	if !App.stateStore.IsEncrypted(roomID) {
-		return event.EventMessage, eventContent, nil
+		return eventType, eventContent, nil
 	}
 
 	log.Debugf("Encrypting event for %s", roomID)
-	encrypted, err := App.olmMachine.EncryptMegolmEvent(roomID, event.EventMessage, eventContent)
+	encrypted, err := App.olmMachine.EncryptMegolmEvent(roomID, eventType, eventContent)
 
 	// These three errors mean we have to make a new Megolm session
 	if err == crypto.SessionExpired || err == crypto.SessionNotShared || err == crypto.NoGroupSession {
 		err = App.olmMachine.ShareGroupSession(roomID, App.stateStore.GetRoomMembers(roomID))
 		if err != nil {
 			log.Errorf("Failed to share group session to %s: %s", roomID, err)
-			return event.EventMessage, eventContent, err
+			return eventType, eventContent, err
 		}
 
-		encrypted, err = App.olmMachine.EncryptMegolmEvent(roomID, event.EventMessage, eventContent)
+		encrypted, err = App.olmMachine.EncryptMegolmEvent(roomID, eventType, eventContent)
 	}
 
 	if err != nil {
 		log.Errorf("Failed to encrypt message to %s: %s", roomID, err)
-		return event.EventMessage, eventContent, err
+		return eventType, eventContent, err
 	}
 
-	encrypted.RelatesTo = eventContent.RelatesTo // The m.relates_to field should be unencrypted, so copy it.
+	encrypted.RelatesTo = relatesTo // The m.relates_to field should be unencrypted, so copy it.
 
 	return event.EventEncrypted, encrypted, nil
 }
 
+func encryptMessageEventContent(roomID id.RoomID, eventContent *event.MessageEventContent) (event.Type, interface{}, error) {
+	return encryptEventContent(roomID, event.EventMessage, eventContent, eventContent.RelatesTo)
+}
+
 func SendMessage(roomId id.RoomID, content *event.MessageEventContent) (resp *mautrix.RespSendEvent, err error) {
 	r, err := DoRetry(fmt.Sprintf("send message to %s", roomId), func() (interface{}, error) {
 		eventType, encrypted, err := encryptMessageEventContent(roomId, content)
@@ -87,32 +103,193 @@ func SendMessage(roomId id.RoomID, content *event.MessageEventContent) (resp *ma
 	return r.(*mautrix.RespSendEvent), err
 }
 
-func SendBoardImage(roomID id.RoomID, board *chess.Board, replyingTo *id.EventID, squares ...chess.Square) (*mautrix.RespSendEvent, error) {
-	pngBytes, err := boardToPngBytes(board, squares...)
+// fetchEvent fetches an event from the room, decrypting it if it is
+// encrypted.
+func fetchEvent(roomID id.RoomID, eventID id.EventID) (*event.Event, error) {
+	evt, err := App.client.GetEvent(roomID, eventID)
 	if err != nil {
 		return nil, err
 	}
+	evt.RoomID = roomID
+	if err := evt.Content.ParseRaw(evt.Type); err != nil {
+		return nil, err
+	}
+	if evt.Type == event.EventEncrypted {
+		return App.olmMachine.DecryptMegolmEvent(evt)
+	}
+	return evt, nil
+}
 
-	upload, err := App.client.UploadBytesWithName(pngBytes, "image/png", "chessboard.png")
+// downloadAttachment downloads the file of a message, decrypting it if it
+// was sent to an encrypted room.
+func downloadAttachment(content *event.MessageEventContent) ([]byte, error) {
+	url := content.URL
+	if content.File != nil {
+		url = content.File.URL
+	}
+	contentURI, err := url.Parse()
+	if err != nil {
+		return nil, err
+	}
+	data, err := App.client.DownloadBytes(contentURI)
 	if err != nil {
 		return nil, err
 	}
+	if content.File != nil {
+		if err := content.File.DecryptInPlace(data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
 
-	content := event.MessageEventContent{
-		MsgType: event.MsgImage,
-		Body:    "chessboard.png",
+// SendNotice sends a plain text notice to the room.
+func SendNotice(roomID id.RoomID, body string) (*mautrix.RespSendEvent, error) {
+	return SendMessage(roomID, &event.MessageEventContent{MsgType: event.MsgNotice, Body: body})
+}
+
+// SendFile uploads the data and sends it to the room as an m.file event.
+func SendFile(roomID id.RoomID, data []byte, mimeType, filename string) (*mautrix.RespSendEvent, error) {
+	content, err := uploadFile(data, mimeType, filename)
+	if err != nil {
+		return nil, err
+	}
+	return SendMessage(roomID, content)
+}
+
+// uploadFile uploads the data and returns the content of an m.file event for
+// it.
+func uploadFile(data []byte, mimeType, filename string) (*event.MessageEventContent, error) {
+	upload, err := App.client.UploadBytesWithName(data, mimeType, filename)
+	if err != nil {
+		return nil, err
+	}
+	return &event.MessageEventContent{
+		MsgType: event.MsgFile,
+		Body:    filename,
 		URL:     upload.ContentURI.CUString(),
+		Info: &event.FileInfo{
+			MimeType: mimeType,
+			Size:     len(data),
+		},
+	}, nil
+}
+
+// uploadImage uploads the image and its thumbnail to the media repository.
+func uploadImage(image *RenderedImage, filename string) (*store.UploadedBoardImage, error) {
+	upload, err := App.client.UploadBytesWithName(image.Data, image.MimeType, filename)
+	if err != nil {
+		return nil, err
+	}
+	thumbnailUpload, err := App.client.UploadBytesWithName(image.Thumbnail, "image/png", "thumbnail-"+filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return &store.UploadedBoardImage{
+		ContentURI:      upload.ContentURI.CUString(),
+		MimeType:        image.MimeType,
+		Width:           image.Width,
+		Height:          image.Height,
+		Size:            len(image.Data),
+		ThumbnailURI:    thumbnailUpload.ContentURI.CUString(),
+		ThumbnailWidth:  image.ThumbnailWidth,
+		ThumbnailHeight: image.ThumbnailHeight,
+		ThumbnailSize:   len(image.Thumbnail),
+		Blurhash:        image.Blurhash,
+	}, nil
+}
+
+// uploadBoardImage returns the uploaded media for the render, rendering and
+// uploading it only if an identical render has not been uploaded before.
+func uploadBoardImage(render BoardRender) (*store.UploadedBoardImage, error) {
+	renderKey := render.CacheKey()
+	if uploaded := App.boardImageCache.GetImage(renderKey); uploaded != nil {
+		log.Debugf("Reusing cached board image %s", uploaded.ContentURI)
+		return uploaded, nil
+	}
+
+	boardImage, err := RenderBoardImage(render)
+	if err != nil {
+		return nil, err
+	}
+	uploaded, err := uploadImage(boardImage, "chessboard.png")
+	if err != nil {
+		return nil, err
 	}
+	if err := App.boardImageCache.SetImage(renderKey, uploaded); err != nil {
+		log.Warnf("Failed to cache board image %s: %v", uploaded.ContentURI, err)
+	}
+	return uploaded, nil
+}
+
+func SendBoardImage(roomID id.RoomID, render BoardRender, description string, replyingTo *id.EventID) (*mautrix.RespSendEvent, error) {
+	uploaded, err := uploadBoardImage(render)
+	if err != nil {
+		return nil, err
+	}
+	return SendImage(roomID, uploaded, description, replyingTo)
+}
 
+// imageMessageContent returns the content of an m.image event for media
+// that has already been uploaded.
+func imageMessageContent(uploaded *store.UploadedBoardImage, description string) *event.MessageEventContent {
+	return &event.MessageEventContent{
+		MsgType: event.MsgImage,
+		Body:    description,
+		URL:     uploaded.ContentURI,
+		Info: &event.FileInfo{
+			MimeType:     uploaded.MimeType,
+			Width:        uploaded.Width,
+			Height:       uploaded.Height,
+			Size:         uploaded.Size,
+			ThumbnailURL: uploaded.ThumbnailURI,
+			ThumbnailInfo: &event.FileInfo{
+				MimeType: "image/png",
+				Width:    uploaded.ThumbnailWidth,
+				Height:   uploaded.ThumbnailHeight,
+				Size:     uploaded.ThumbnailSize,
+			},
+		},
+	}
+}
+
+// SendImage sends an m.image event for media that has already been uploaded.
+// If replyingTo is set, the image is sent in the thread of that event.
+func SendImage(roomID id.RoomID, uploaded *store.UploadedBoardImage, description string, replyingTo *id.EventID) (*mautrix.RespSendEvent, error) {
+	messageEventContent := imageMessageContent(uploaded, description)
 	if replyingTo != nil {
-		content.SetRelatesTo(&event.RelatesTo{
+		messageEventContent.SetRelatesTo(&event.RelatesTo{
 			Type:    event.RelationType("m.thread"),
 			EventID: *replyingTo,
 		})
 	}
+	return sendImageContent(roomID, messageEventContent, uploaded.Blurhash)
+}
+
+// EditImage replaces the image of an m.image event with media that has
+// already been uploaded.
+func EditImage(roomID id.RoomID, eventID id.EventID, uploaded *store.UploadedBoardImage, description string) (*mautrix.RespSendEvent, error) {
+	messageEventContent := imageMessageContent(uploaded, description)
+	messageEventContent.SetEdit(eventID)
+	messageEventContent.Body = "* " + description
+	return sendImageContent(roomID, messageEventContent, uploaded.Blurhash)
+}
+
+func sendImageContent(roomID id.RoomID, messageEventContent *event.MessageEventContent, blurhash string) (*mautrix.RespSendEvent, error) {
+	// The blurhash (MSC2448) isn't part of FileInfo, so merge it into the info
+	// block using the raw content.
+	info := map[string]interface{}{
+		"xyz.amorgan.blurhash": blurhash,
+	}
+	raw := map[string]interface{}{"info": info}
+	if messageEventContent.NewContent != nil {
+		raw["m.new_content"] = map[string]interface{}{"info": info}
+	}
+	content := event.Content{Parsed: messageEventContent, Raw: raw}
 
-	r, err := DoRetry(fmt.Sprintf("send chess board image to %s", roomID), func() (interface{}, error) {
-		eventType, encrypted, err := encryptMessageEventContent(roomID, &content)
+	r, err := DoRetry(fmt.Sprintf("send image to %s", roomID), func() (interface{}, error) {
+		eventType, encrypted, err := encryptEventContent(roomID, event.EventMessage, &content, messageEventContent.RelatesTo)
 		if err != nil {
 			return nil, err
 		}
@@ -126,3 +303,22 @@ func SendBoardImage(roomID id.RoomID, board *chess.Board, replyingTo *id.EventID
 	}
 	return r.(*mautrix.RespSendEvent), err
 }
+
+// SendReaction reacts to the event with the key.
+func SendReaction(roomID id.RoomID, eventID id.EventID, key string) (*mautrix.RespSendEvent, error) {
+	content := event.ReactionEventContent{
+		RelatesTo: event.RelatesTo{Type: event.RelAnnotation, EventID: eventID, Key: key},
+	}
+	r, err := DoRetry(fmt.Sprintf("send reaction to %s", roomID), func() (interface{}, error) {
+		eventType, encrypted, err := encryptEventContent(roomID, event.EventReaction, &content, &content.RelatesTo)
+		if err != nil {
+			return nil, err
+		}
+		return App.client.SendMessageEvent(roomID, eventType, encrypted)
+	})
+	if err != nil {
+		log.Errorf("Failed to send reaction to %s: %s", roomID, err)
+		return nil, err
+	}
+	return r.(*mautrix.RespSendEvent), err
+}
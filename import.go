@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/notnil/chess"
+	log "github.com/sirupsen/logrus"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+
+	"github.com/nevarro-space/matrix-chessbot/store"
+)
+
+// maxImportedGames limits how many games are imported from a single file.
+const maxImportedGames = 20
+
+// maxPGNFileSize limits the size of the PGN files that are downloaded, which
+// is plenty for maxImportedGames games.
+const maxPGNFileSize = 1 << 20
+
+func isPGNAttachment(content *mevent.MessageEventContent) bool {
+	return content.MsgType == mevent.MsgFile && strings.HasSuffix(strings.ToLower(content.Body), ".pgn")
+}
+
+// splitPGNGames splits a PGN file into its games. A game starts at the first
+// tag pair after the movetext of the previous game. This doesn't use
+// chess.Scanner because it only recognises movetext that starts with "1. ".
+func splitPGNGames(data string) []string {
+	data = strings.TrimPrefix(strings.ReplaceAll(data, "\r\n", "\n"), "\ufeff")
+	games := make([]string, 0)
+	var current strings.Builder
+	inMoves := false
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		isTagPair := strings.HasPrefix(line, "[")
+		if isTagPair && inMoves {
+			games = append(games, current.String())
+			current.Reset()
+			inMoves = false
+		} else if line != "" && !isTagPair {
+			inMoves = true
+		}
+		current.WriteString(line + "\n")
+	}
+	if strings.TrimSpace(current.String()) != "" {
+		games = append(games, current.String())
+	}
+	return games
+}
+
+// parsePGNGames parses the games split from a PGN file, stopping once it has
+// parsed limit games. Games that can't be parsed are skipped, and counted in
+// skipped.
+func parsePGNGames(texts []string, limit int) (games []*chess.Game, skipped int) {
+	games = make([]*chess.Game, 0)
+	for _, text := range texts {
+		if len(games) == limit {
+			break
+		}
+		pgn, err := chess.PGN(strings.NewReader(text))
+		if err != nil {
+			log.Debugf("Skipping a game that can't be parsed: %v", err)
+			skipped++
+			continue
+		}
+		games = append(games, chess.NewGame(pgn))
+	}
+	return games, skipped
+}
+
+// gameTitle describes a game by its players, for example "Alice vs Bob".
+func gameTitle(game Game) string {
+	player := func(key string) string {
+		if tag := game.GetTagPair(key); tag != nil && tag.Value != "" && tag.Value != "?" {
+			return tag.Value
+		}
+		return "?"
+	}
+	return fmt.Sprintf("%s vs %s", player("White"), player("Black"))
+}
+
+// importPGNAttachment downloads a PGN file, stores its games and offers to
+// continue them.
+func importPGNAttachment(roomID mid.RoomID, content *mevent.MessageEventContent) {
+	tooLarge := fmt.Sprintf("%s is too large to import. PGN files can be up to %d KiB.", content.Body, maxPGNFileSize/1024)
+	if content.Info != nil && content.Info.Size > maxPGNFileSize {
+		SendNotice(roomID, tooLarge)
+		return
+	}
+	data, err := downloadAttachment(content)
+	if err != nil {
+		log.Errorf("Failed to download %s: %v", content.Body, err)
+		SendNotice(roomID, fmt.Sprintf("Failed to download %s.", content.Body))
+		return
+	}
+	// The size in the message is only what the sender's client says.
+	if len(data) > maxPGNFileSize {
+		SendNotice(roomID, tooLarge)
+		return
+	}
+	texts := splitPGNGames(string(data))
+	games, skipped := parsePGNGames(texts, maxImportedGames)
+	if len(games) == 0 {
+		log.Warnf("Failed to parse %s: %d games couldn't be parsed", content.Body, skipped)
+		SendNotice(roomID, fmt.Sprintf("Couldn't find any games in %s.", content.Body))
+		return
+	}
+
+	var notice strings.Builder
+	if len(games)+skipped < len(texts) {
+		fmt.Fprintf(&notice, "Only the first %d of the %d games in %s were imported:\n", len(games), len(texts), content.Body)
+	} else {
+		fmt.Fprintf(&notice, "Games imported from %s:\n", content.Body)
+	}
+	for _, game := range games {
+		imported := store.ImportedGame{
+			ID:         newGameID(),
+			RoomID:     roomID,
+			PGN:        game.String(),
+			ImportedAt: time.Now(),
+		}
+		if err := App.importedGameStore.SaveImportedGame(&imported); err != nil {
+			log.Errorf("Failed to save imported game: %v", err)
+			continue
+		}
+		fmt.Fprintf(&notice, "%s: %s, %s after %d moves\n", imported.ID, gameTitle(game), game.Outcome(), (len(game.Moves())+1)/2)
+	}
+	if skipped == 1 {
+		notice.WriteString("1 game couldn't be parsed and was skipped.\n")
+	} else if skipped > 1 {
+		fmt.Fprintf(&notice, "%d games couldn't be parsed and were skipped.\n", skipped)
+	}
+	notice.WriteString("Send `!chess continue <ID>` to continue the final position of a game as a new game, or `!chess replay <ID>` to step through it.")
+	SendNotice(roomID, notice.String())
+
+	if len(games) == 1 {
+		game := games[0]
+		render := BoardRender{Board: game.Position().Board(), Style: DefaultBoardStyle()}
+		if _, err := SendBoardImage(roomID, render, describePosition(game.Position(), lastMoveString(game)), nil); err != nil {
+			log.Errorf("Failed to send board image: %v", err)
+		}
+	}
+}
+
+// handleImportCommand imports the PGN file that the command replies to.
+func handleImportCommand(event *mevent.Event) {
+	replyTo := event.Content.AsMessage().GetReplyTo()
+	if replyTo == "" {
+		SendNotice(event.RoomID, "Reply to a .pgn file with `!chess import` to import it.")
+		return
+	}
+	original, err := fetchEvent(event.RoomID, replyTo)
+	if err != nil {
+		log.Errorf("Failed to fetch %s: %v", replyTo, err)
+		SendNotice(event.RoomID, "Failed to fetch the message being replied to.")
+		return
+	}
+	content := original.Content.AsMessage()
+	if original.Type != mevent.EventMessage || !isPGNAttachment(content) {
+		SendNotice(event.RoomID, "That message isn't a .pgn file.")
+		return
+	}
+	importPGNAttachment(event.RoomID, content)
+}
+
+// handleContinueCommand starts a new game from the final position of an
+// imported game.
+func handleContinueCommand(event *mevent.Event, args []string) {
+	args = nonEmpty(args)
+	if len(args) != 1 {
+		SendNotice(event.RoomID, "Usage: continue <imported game ID>")
+		return
+	}
+	imported := App.importedGameStore.GetImportedGame(args[0])
+	if imported == nil || imported.RoomID != event.RoomID {
+		SendNotice(event.RoomID, fmt.Sprintf("There is no imported game %s in this room.", args[0]))
+		return
+	}
+	pgn, err := chess.PGN(strings.NewReader(imported.PGN))
+	if err != nil {
+		log.Errorf("Failed to parse imported game %s: %v", imported.ID, err)
+		return
+	}
+	position := chess.NewGame(pgn).Position()
+	if len(position.ValidMoves()) == 0 {
+		SendNotice(event.RoomID, "The game is already over.")
+		return
+	}
+	startGameFromFEN(event.RoomID, position.String(), StateChessGameEventContent{GameID: newGameID(), TimeControl: "-"})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitPGNGames(t *testing.T) {
+	testCases := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{"empty", "", []string{}},
+		{
+			"one game",
+			"[White \"Alice\"]\n[Black \"Bob\"]\n\n1. e4 e5 *\n",
+			[]string{"[White \"Alice\"]\n[Black \"Bob\"]\n\n1. e4 e5 *\n\n"},
+		},
+		{
+			"two games",
+			"[White \"Alice\"]\n\n1. e4 e5 1-0\n\n[White \"Bob\"]\n\n1. d4 d5 0-1\n",
+			[]string{"[White \"Alice\"]\n\n1. e4 e5 1-0\n\n", "[White \"Bob\"]\n\n1. d4 d5 0-1\n\n"},
+		},
+		{
+			"movetext over several lines",
+			"[White \"Alice\"]\n\n1. e4 e5\n2. Nf3 Nc6 *\n[White \"Bob\"]\n1. d4 *",
+			[]string{"[White \"Alice\"]\n\n1. e4 e5\n2. Nf3 Nc6 *\n", "[White \"Bob\"]\n1. d4 *\n"},
+		},
+		{
+			"CRLF line endings and a byte order mark",
+			"\ufeff[White \"Alice\"]\r\n\r\n1. e4 *\r\n",
+			[]string{"[White \"Alice\"]\n\n1. e4 *\n\n"},
+		},
+		{
+			"movetext that doesn't start with 1.",
+			"[FEN \"4k3/8/8/8/8/8/8/4K2R b K - 0 1\"]\n\n1... Kd7 2. O-O *\n",
+			[]string{"[FEN \"4k3/8/8/8/8/8/8/4K2R b K - 0 1\"]\n\n1... Kd7 2. O-O *\n\n"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := splitPGNGames(tc.data); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("splitPGNGames(%q) = %q, want %q", tc.data, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParsePGNGamesSkipsBadGames(t *testing.T) {
+	data := "[White \"Alice\"]\n\n1. e4 e5 *\n\n" +
+		"[White \"Bob\"]\n\n1. e4 e4 *\n\n" +
+		"[White \"Carol\"]\n\n1. d4 d5 2. c4 *\n"
+	testCases := []struct {
+		name    string
+		limit   int
+		white   []string
+		skipped int
+	}{
+		{"every game", maxImportedGames, []string{"Alice", "Carol"}, 1},
+		{"stops at the limit", 1, []string{"Alice"}, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			games, skipped := parsePGNGames(splitPGNGames(data), tc.limit)
+			if len(games) != len(tc.white) || skipped != tc.skipped {
+				t.Fatalf("parsed %d games and skipped %d, want %d and %d", len(games), skipped, len(tc.white), tc.skipped)
+			}
+			for i, want := range tc.white {
+				if tag := games[i].GetTagPair("White"); tag == nil || tag.Value != want {
+					t.Errorf("game %d has White %v, want %s", i, tag, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/notnil/chess"
+)
+
+// VariantKingOfTheHill is the value of the PGN Variant tag for King of the
+// Hill games.
+const VariantKingOfTheHill = "King of the Hill"
+
+// hillSquares are the four centre squares that a king wins by reaching.
+var hillSquares = []chess.Square{chess.D4, chess.E4, chess.D5, chess.E5}
+
+// kingOfTheHillVariant is King of the Hill, where a king reaching the centre
+// wins.
+type kingOfTheHillVariant struct{}
+
+func (kingOfTheHillVariant) Name() string {
+	return VariantKingOfTheHill
+}
+
+func (kingOfTheHillVariant) StartingFEN() string {
+	return chess.StartingPosition().String()
+}
+
+func (kingOfTheHillVariant) Outcome(position *variantPosition) (chess.Outcome, string) {
+	board := position.position.Board()
+	for _, sq := range hillSquares {
+		switch board.Piece(sq) {
+		case chess.WhiteKing:
+			return chess.WhiteWon, fmt.Sprintf("White's king reached %s.", sq)
+		case chess.BlackKing:
+			return chess.BlackWon, fmt.Sprintf("Black's king reached %s.", sq)
+		}
+	}
+	return chess.NoOutcome, ""
+}
+
+// InsufficientMaterialDraws is false because a lone king can still win by
+// reaching the centre.
+func (kingOfTheHillVariant) InsufficientMaterialDraws() bool {
+	return false
+}
+
+func (kingOfTheHillVariant) Evaluated() bool {
+	return false
+}
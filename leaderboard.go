@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+
+	"github.com/nevarro-space/matrix-chessbot/store"
+)
+
+const leaderboardSize = 10
+
+// handleLeaderboardCommand posts the top rated players in a pool, either of
+// the members of the room or of everyone the bot has rated.
+func handleLeaderboardCommand(roomID mid.RoomID, args []string) {
+	pool, global := PoolCorrespondence, false
+	for _, arg := range args {
+		switch arg = strings.ToLower(arg); arg {
+		case "":
+		case "room":
+			global = false
+		case "global":
+			global = true
+		default:
+			if !isRatingPool(arg) {
+				SendNotice(roomID, fmt.Sprintf("Unknown option %s. Usage: leaderboard [%s] [room|global]", arg, strings.Join(RatingPools, "|")))
+				return
+			}
+			pool = arg
+		}
+	}
+
+	ratings := App.ratingStore.GetRatingsInPool(pool, provisionalDeviation)
+	if !global {
+		members := map[mid.UserID]bool{}
+		for _, member := range App.stateStore.GetRoomMembers(roomID) {
+			members[member] = true
+		}
+		inRoom := make([]*store.Rating, 0, len(ratings))
+		for _, rating := range ratings {
+			if members[rating.UserID] {
+				inRoom = append(inRoom, rating)
+			}
+		}
+		ratings = inRoom
+	}
+	if len(ratings) > leaderboardSize {
+		ratings = ratings[:leaderboardSize]
+	}
+
+	scope := "this room"
+	if global {
+		scope = "all rooms"
+	}
+	title := fmt.Sprintf("Top %s players in %s", pool, scope)
+	if len(ratings) == 0 {
+		SendNotice(roomID, fmt.Sprintf("%s: nobody has an established %s rating yet.", title, pool))
+		return
+	}
+
+	var text, table strings.Builder
+	fmt.Fprintf(&text, "%s:\n", title)
+	fmt.Fprintf(&table, "<b>%s</b>\n<table>\n<tr><th>#</th><th>Player</th><th>Rating</th><th>Games</th><th>Win rate</th></tr>\n", html.EscapeString(title))
+	for i, rating := range ratings {
+		name := getDisplayName(roomID, rating.UserID)
+		winRate := fmt.Sprintf("%.0f%%", 100*float64(rating.Wins)/float64(rating.Games))
+		fmt.Fprintf(&text, "%d. %s %s (%d games, %s won)\n", i+1, name, formatRating(rating), rating.Games, winRate)
+		fmt.Fprintf(&table, "<tr><td>%d</td><td>%s</td><td>%s</td><td>%d</td><td>%s</td></tr>\n",
+			i+1, html.EscapeString(name), formatRating(rating), rating.Games, winRate)
+	}
+	table.WriteString("</table>")
+
+	SendMessage(roomID, &mevent.MessageEventContent{
+		MsgType:       mevent.MsgNotice,
+		Body:          strings.TrimSpace(text.String()),
+		Format:        mevent.FormatHTML,
+		FormattedBody: table.String(),
+	})
+}
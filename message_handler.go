@@ -3,38 +3,70 @@ package main
 import (
 	"errors"
 	"fmt"
-	"image/color"
-	"io"
-	"os"
-	"os/exec"
 	"regexp"
 	"strings"
-	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/notnil/chess"
-	cimage "github.com/notnil/chess/image"
 	log "github.com/sirupsen/logrus"
 	"maunium.net/go/mautrix"
 	mevent "maunium.net/go/mautrix/event"
 	mid "maunium.net/go/mautrix/id"
-)
 
-var fenRegex = regexp.MustCompile(`([rnbqkpRNBQKP1-8]{1,8}\/?){8}\s+[wb]\s+(-|K?Q?k?q?)\s+(-|[a-h][3-6])\s+\d+\s+\d+`)
+	"github.com/nevarro-space/matrix-chessbot/store"
+)
 
 func sendHelp(roomId mid.RoomID) {
 	// send message to channel confirming join (retry 3 times)
 	noticeText := `COMMANDS:
-* new -- start a new game of chess
+* new [rated|casual] [minutes+increment] -- start a new game of chess. Games are rated by default. The time control sets the rating pool, but the clock is not enforced
+* new [rated|casual] [minutes+increment] 960 [position] -- start a game of Chess960 from a random position, or from the numbered one (0-959, 518 is the standard position)
+* new [rated|casual] [minutes+increment] crazyhouse -- start a game of Crazyhouse, where captured pieces can be dropped back on the board with moves like N@f3
+* new [rated|casual] [minutes+increment] threecheck|koth -- start a game of Three-check, where giving a third check wins, or of King of the Hill, where a king reaching the centre wins
+* new [minutes+increment] bughouse @white1 @black2 vs @black1 @white2 -- start a Bughouse match on two boards. Partners play opposite colours, and the pieces one captures go to the other's pocket
+* new [minutes+increment] vote [white|black] @user|engine -- play a side as a room against a player or the engine. The bot opens a poll on each of the room's moves and plays the move with the most votes. Moves can also be voted for by sending them
+* new [casual] [minutes+increment] fen <FEN> -- start a casual game from a position
+* play this [number] -- reply to a FEN or to a board rendered from one to start a casual game from that position. Give the number of the position for a grid of boards
+* import -- reply to a .pgn file to import its games. Uploaded .pgn files are imported automatically
+* continue <ID> -- continue the final position of an imported game as a new game
+* replay [game ID] -- step through the current game, an archived game or an imported game
+* explore [game ID|fen <FEN>] -- open a thread to try out lines from a game or a position without touching the real game. Send moves, back [n], branch [n], mainline or pgn in the thread
+* leaderboard [bullet|blitz|rapid|correspondence] [room|global] -- show the top rated players in a pool. Defaults to correspondence games in this room
+* stats [@user] [vs @user] -- show a player's results, favourite openings and win streak, optionally with their record against an opponent
+* claim -- claim a draw by threefold repetition or the fifty-move rule. Write claim after a move, like Nf3 claim, to claim a draw that the move brings about
+* draw -- offer your opponent a draw, which they accept by reacting with 🤝
+* takeback -- ask your opponent to let you take back your last move, which they allow by reacting with ✅
+* pgn [game|<game ID>|all|@user|since YYYY-MM-DD] -- upload the PGN of the current game, or of games played in this room
 * help -- show this help
 
+Play by sending moves in SAN. A move can be followed by a glyph and a comment, like Nf3 !? trying to provoke g5 or e4 {main idea}, which are kept in the PGN. Edit your move to change it until your opponent replies. React to the board with 🔄 to flip it.
+
 Version %s. Source code: https://github.com/nevarro-space/matrix-chessbot`
 	noticeHtml := `<b>COMMANDS:</b>
 <ul>
-<li><b>new</b> &mdash; start a new game of chess</li>
+<li><b>new</b> [rated|casual] [minutes+increment] &mdash; start a new game of chess. Games are rated by default. The time control sets the rating pool, but the clock is not enforced</li>
+<li><b>new</b> [rated|casual] [minutes+increment] 960 [position] &mdash; start a game of Chess960 from a random position, or from the numbered one (0-959, 518 is the standard position)</li>
+<li><b>new</b> [rated|casual] [minutes+increment] crazyhouse &mdash; start a game of Crazyhouse, where captured pieces can be dropped back on the board with moves like <code>N@f3</code></li>
+<li><b>new</b> [rated|casual] [minutes+increment] threecheck|koth &mdash; start a game of Three-check, where giving a third check wins, or of King of the Hill, where a king reaching the centre wins</li>
+<li><b>new</b> [minutes+increment] bughouse @white1 @black2 vs @black1 @white2 &mdash; start a Bughouse match on two boards. Partners play opposite colours, and the pieces one captures go to the other's pocket</li>
+<li><b>new</b> [minutes+increment] vote [white|black] @user|engine &mdash; play a side as a room against a player or the engine. The bot opens a poll on each of the room's moves and plays the move with the most votes. Moves can also be voted for by sending them</li>
+<li><b>new</b> [casual] [minutes+increment] fen &lt;FEN&gt; &mdash; start a casual game from a position</li>
+<li><b>play this</b> [number] &mdash; reply to a FEN or to a board rendered from one to start a casual game from that position. Give the number of the position for a grid of boards</li>
+<li><b>import</b> &mdash; reply to a .pgn file to import its games. Uploaded .pgn files are imported automatically</li>
+<li><b>continue</b> &lt;ID&gt; &mdash; continue the final position of an imported game as a new game</li>
+<li><b>replay</b> [game ID] &mdash; step through the current game, an archived game or an imported game</li>
+<li><b>explore</b> [game ID|fen &lt;FEN&gt;] &mdash; open a thread to try out lines from a game or a position without touching the real game. Send moves, back [n], branch [n], mainline or pgn in the thread</li>
+<li><b>leaderboard</b> [bullet|blitz|rapid|correspondence] [room|global] &mdash; show the top rated players in a pool. Defaults to correspondence games in this room</li>
+<li><b>stats</b> [@user] [vs @user] &mdash; show a player's results, favourite openings and win streak, optionally with their record against an opponent</li>
+<li><b>claim</b> &mdash; claim a draw by threefold repetition or the fifty-move rule. Write claim after a move, like <code>Nf3 claim</code>, to claim a draw that the move brings about</li>
+<li><b>draw</b> &mdash; offer your opponent a draw, which they accept by reacting with 🤝</li>
+<li><b>takeback</b> &mdash; ask your opponent to let you take back your last move, which they allow by reacting with ✅</li>
+<li><b>pgn</b> [game|&lt;game ID&gt;|all|@user|since YYYY-MM-DD] &mdash; upload the PGN of the current game, or of games played in this room</li>
 <li><b>help</b> &mdash; show this help</li>
 </ul>
 
+Play by sending moves in SAN. A move can be followed by a glyph and a comment, like <code>Nf3 !? trying to provoke g5</code> or <code>e4 {main idea}</code>, which are kept in the PGN. Edit your move to change it until your opponent replies. React to the board with 🔄 to flip it.
+
 Version %s. <a href="https://github.com/nevarro-space/matrix-chessbot">Source code</a>.`
 
 	SendMessage(roomId, &mevent.MessageEventContent{
@@ -88,73 +120,43 @@ func getCommandParts(body string) ([]string, error) {
 	return commandParts, nil
 }
 
-func boardToPngBytes(board *chess.Board, squares ...chess.Square) ([]byte, error) {
-	svgTempfile, err := os.CreateTemp(os.TempDir(), "chessboard-*.svg")
-	if err != nil {
-		return []byte{}, err
-	}
-	defer os.Remove(svgTempfile.Name())
+func handleCommand(source mautrix.EventSource, event *mevent.Event, commandParts []string) {
+	switch strings.ToLower(commandParts[0]) {
+	case "new":
+		handleNewCommand(event.RoomID, commandParts[1:])
 
-	// write board SVG to file
-	yellow := color.RGBA{255, 255, 0, 1}
-	mark := cimage.MarkSquares(yellow, squares...)
-	if err := cimage.SVG(svgTempfile, board, mark); err != nil {
-		log.Fatal(err)
-	}
+	case "play":
+		handlePlayCommand(event, commandParts[1:])
 
-	pngTempfile, err := os.CreateTemp(os.TempDir(), "chessboard-*.png")
-	if err != nil {
-		return []byte{}, err
-	}
-	defer os.Remove(pngTempfile.Name())
+	case "import":
+		handleImportCommand(event)
 
-	cmd := exec.Command("convert", svgTempfile.Name(), pngTempfile.Name())
-	err = cmd.Run()
-	if err != nil {
-		return []byte{}, err
-	}
+	case "continue":
+		handleContinueCommand(event, commandParts[1:])
 
-	pngFile, err := os.Open(pngTempfile.Name())
-	if err != nil {
-		return []byte{}, err
-	}
-	defer pngFile.Close()
+	case "replay":
+		handleReplayCommand(event, commandParts[1:])
 
-	return io.ReadAll(pngFile)
-}
+	case "explore":
+		handleExploreCommand(event, commandParts[1:])
 
-var StateChessGame = mevent.Type{Type: "space.nevarro.chess.game", Class: mevent.StateEventType}
+	case "claim":
+		handleClaimCommand(event)
 
-type StateChessGameEventContent struct {
-	PGN               string
-	BoardImageEventID mid.EventID
-}
+	case "draw":
+		handleOfferCommand(event, OfferDraw)
 
-func saveGame(roomID mid.RoomID, game *chess.Game, boardImageEventID mid.EventID) (resp *mautrix.RespSendEvent, err error) {
-	return App.client.SendStateEvent(roomID, StateChessGame, "", StateChessGameEventContent{
-		PGN:               game.String(),
-		BoardImageEventID: boardImageEventID,
-	})
-}
+	case "takeback":
+		handleOfferCommand(event, OfferTakeBack)
 
-func getGameStateEvent(roomID mid.RoomID) (*StateChessGameEventContent, error) {
-	var chessGame StateChessGameEventContent
-	err := App.client.StateEvent(roomID, StateChessGame, "", &chessGame)
-	if err != nil {
-		return nil, err
-	}
-	return &chessGame, nil
-}
+	case "leaderboard":
+		handleLeaderboardCommand(event.RoomID, commandParts[1:])
 
-func handleCommand(source mautrix.EventSource, event *mevent.Event, commandParts []string) {
-	switch strings.ToLower(commandParts[0]) {
-	case "new":
-		game := chess.NewGame()
-		game.AddTagPair("Event", fmt.Sprintf("%s @ %s", event.RoomID.String(), time.Now()))
-		boardImageEvent, err := SendBoardImage(event.RoomID, game.Position().Board(), nil)
-		if err == nil {
-			saveGame(event.RoomID, game, boardImageEvent.EventID)
-		}
+	case "stats":
+		handleStatsCommand(event, commandParts[1:])
+
+	case "pgn":
+		handlePGNCommand(event, commandParts[1:])
 
 	default:
 		sendHelp(event.RoomID)
@@ -187,53 +189,129 @@ func HandleMessage(source mautrix.EventSource, event *mevent.Event) {
 		relatedEventID = event.ID
 	}
 
-	if commandParts, err := getCommandParts(messageEventContent.Body); err == nil {
-		handleCommand(source, event, commandParts)
-	} else if fenStr := fenRegex.FindString(messageEventContent.Body); fenStr != "" {
-		fen, err := chess.FEN(fenStr)
-		if err != nil {
-			log.Errorf("Unable to parse FEN (%s): %v", fenStr, err)
+	// Look for positions in the new content of edits rather than in the
+	// fallback body.
+	positionContent := messageEventContent
+	if relatesTo != nil && relatesTo.Type == mevent.RelReplace && messageEventContent.NewContent != nil {
+		positionContent = messageEventContent.NewContent
+	}
+
+	// Navigation commands in the thread of a replay, or in reply to it. Other
+	// messages there discuss the replayed game, so they don't reach the real
+	// game either.
+	if relatesTo != nil && (relatesTo.Type == mevent.RelationType("m.thread") || relatesTo.Type == mevent.RelReply) {
+		if replay := App.replayStore.GetReplay(event.RoomID, relatesTo.EventID); replay != nil {
+			command, err := getCommandParts(messageEventContent.Body)
+			if err != nil {
+				command = strings.Fields(messageEventContent.Body)
+			}
+			navigateReplay(replay, command)
 			return
 		}
-
-		game := chess.NewGame(fen)
-		resp, err := SendBoardImage(event.RoomID, game.Position().Board(), &relatedEventID)
-		if err != nil {
-			log.Errorf("Failed to send board image: %v", err)
+		// Everything in an analysis thread stays out of the real game.
+		if exploration := App.explorationStore.GetExploration(event.RoomID, relatesTo.EventID); exploration != nil {
+			command, err := getCommandParts(messageEventContent.Body)
+			if err != nil {
+				command = strings.Fields(messageEventContent.Body)
+			}
+			handleExplorationMessage(exploration, command)
 			return
 		}
+	}
 
-		App.fenImageStore.SetEventID(event.RoomID, relatedEventID, resp.EventID)
+	// An edit of the last move replaces it, if the opponent hasn't replied.
+	if relatesTo != nil && relatesTo.Type == mevent.RelReplace {
+		if moveEvent := App.moveEventStore.GetMoveEvent(event.RoomID, relatesTo.EventID); moveEvent != nil {
+			editMove(event, moveEvent, positionContent.Body)
+			return
+		}
+	}
 
-		return
+	if isPGNAttachment(messageEventContent) {
+		importPGNAttachment(event.RoomID, messageEventContent)
+	} else if commandParts, err := getCommandParts(messageEventContent.Body); err == nil {
+		handleCommand(source, event, commandParts)
+	} else if game := findPGN(positionContent); game != nil {
+		sendPGNPosition(event.RoomID, relatedEventID, game)
+	} else if fens := findFENs(positionContent); len(fens) > 0 {
+		sendFENPositions(event.RoomID, relatedEventID, fens)
 	} else {
 		gameStateEvent, err := getGameStateEvent(event.RoomID)
 		if err != nil {
 			return
 		}
-		pgn, err := chess.PGN(strings.NewReader(gameStateEvent.PGN))
-		if err != nil {
+		if gameStateEvent.Bughouse != nil {
+			handleBughouseMove(event, gameStateEvent, messageEventContent.Body)
 			return
 		}
-		game := chess.NewGame(pgn)
-
-		if err != nil {
+		game, err := gameStateEvent.parseGame()
+		if err != nil || game.Outcome() != chess.NoOutcome {
 			return
 		}
-		if err = game.MoveStr(messageEventContent.Body); err != nil {
+		if gameStateEvent.Vote != nil && handleVoteMessage(event, gameStateEvent, game, messageEventContent.Body) {
 			return
 		}
-		moves := game.Moves()
-		last := moves[len(moves)-1]
+		playMove(event, event.ID, gameStateEvent, game, messageEventContent.Body)
+	}
+}
 
-		App.client.RedactEvent(event.RoomID, gameStateEvent.BoardImageEventID)
-		resp, err := SendBoardImage(event.RoomID, game.Position().Board(), nil, last.S1(), last.S2())
-		if err != nil {
-			return
+// playMove plays the move in the message, if the sender is the player to
+// move, and sends the new board. The move is recorded as played by the
+// message with moveEventID, which is the message itself unless it was
+// edited. It returns false if the message isn't a legal move by the player.
+func playMove(event *mevent.Event, moveEventID mid.EventID, gameStateEvent *StateChessGameEventContent, game Game, body string) bool {
+	body, claim := splitClaim(body)
+	move, annotation := parseAnnotatedMove(body)
+
+	// Only the player of the side to move may move. Until a side has
+	// moved, anyone may claim it by making its first move.
+	turn := game.Position().Turn()
+	if player := gameStateEvent.Player(turn); player != "" && player != event.Sender {
+		return false
+	}
+	if err := game.MoveStr(move); err != nil {
+		return false
+	}
+	annotateLastMove(game, annotation)
+	if claim && game.Outcome() == chess.NoOutcome {
+		if err := claimDraw(game); err != nil {
+			SendNotice(event.RoomID, fmt.Sprintf("Can't claim a draw after %s: %v. The move wasn't played.", move, err))
+			return true
 		}
-		_, err = saveGame(event.RoomID, game, resp.EventID)
-		if err != nil {
-			return
+	}
+	gameStateEvent.SetPlayer(turn, event.Sender)
+	showMove(event.RoomID, moveEventID, gameStateEvent, game)
+	return true
+}
+
+// showMove sends the board after the move that was just played and saves
+// the game. The move is recorded as played by the message with moveEventID,
+// unless it is empty because nobody sent the move.
+func showMove(roomID mid.RoomID, moveEventID mid.EventID, gameStateEvent *StateChessGameEventContent, game Game) {
+	gameStateEvent.addEvaluation(game)
+
+	App.client.RedactEvent(roomID, gameStateEvent.BoardImageEventID)
+	render := gameBoardRender(roomID, gameStateEvent, game, lastMoveSquares(game)...)
+	resp, err := SendBoardImage(roomID, render, describeGamePosition(game), nil)
+	if err != nil {
+		return
+	}
+	gameStateEvent.BoardImageEventID = resp.EventID
+	_, err = saveGame(roomID, game, gameStateEvent)
+	if err != nil {
+		return
+	}
+	if moveEventID != "" {
+		moveEvent := store.MoveEvent{RoomID: roomID, EventID: moveEventID, GameID: gameStateEvent.GameID, Ply: len(game.Moves())}
+		if err := App.moveEventStore.SetMoveEvent(&moveEvent); err != nil {
+			log.Errorf("Failed to save move event %s: %v", moveEventID, err)
 		}
 	}
+
+	if game.Outcome() != chess.NoOutcome {
+		finishGame(roomID, gameStateEvent, game)
+	} else if notice := claimNotice(roomID, gameStateEvent, game); notice != "" {
+		SendNotice(roomID, notice)
+	}
+	nextVoteTurn(roomID, gameStateEvent, game)
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/notnil/chess"
+	log "github.com/sirupsen/logrus"
+	mevent "maunium.net/go/mautrix/event"
+
+	"github.com/nevarro-space/matrix-chessbot/store"
+)
+
+// TakeBack takes back the last move. notnil/chess can't take moves back, so
+// the game is played again without it.
+func (g *StandardGame) TakeBack() error {
+	moves := g.Moves()
+	if len(moves) == 0 {
+		return errors.New("there is no move to take back")
+	}
+	fen, err := chess.FEN(g.Positions()[0].String())
+	if err != nil {
+		return err
+	}
+	game := chess.NewGame(fen, chess.TagPairs(g.TagPairs()))
+	for _, move := range moves[:len(moves)-1] {
+		if err := game.Move(move); err != nil {
+			return err
+		}
+	}
+	g.Game = game
+	g.nags, g.comments = g.nags[:len(moves)-1], g.comments[:len(moves)-1]
+	return nil
+}
+
+// TakeBack takes back the last move, along with any outcome that it led to.
+func (g *VariantGame) TakeBack() error {
+	n := len(g.moves) - 1
+	if n < 0 {
+		return errors.New("there is no move to take back")
+	}
+	g.positions, g.moves, g.sans = g.positions[:n+1], g.moves[:n], g.sans[:n]
+	g.nags, g.comments = g.nags[:n], g.comments[:n]
+	g.outcome, g.method, g.termination = chess.NoOutcome, chess.NoMethod, ""
+	return nil
+}
+
+// takeBack takes back the last move of the game.
+func takeBack(game Game) error {
+	switch game := game.(type) {
+	case *StandardGame:
+		return game.TakeBack()
+	case *VariantGame:
+		return game.TakeBack()
+	}
+	return errors.New("moves can't be taken back in this game")
+}
+
+// editMove replaces the move played by the message with the move in its
+// edit, as long as it is still the last move of the current game.
+func editMove(event *mevent.Event, moveEvent *store.MoveEvent, body string) {
+	gameState, err := getGameStateEvent(event.RoomID)
+	if err != nil || gameState.GameID != moveEvent.GameID {
+		SendNotice(event.RoomID, "The move can't be changed because its game is no longer being played.")
+		return
+	}
+	game, err := gameState.parseGame()
+	if err != nil {
+		log.Errorf("Failed to parse game %s: %v", gameState.GameID, err)
+		return
+	}
+	positions := game.Positions()
+	plies := len(positions) - 1
+	if plies < moveEvent.Ply || moveEvent.Ply == 0 {
+		return
+	}
+	if gameState.Player(positions[moveEvent.Ply-1].Turn()) != event.Sender {
+		return
+	}
+	if game.Outcome() != chess.NoOutcome {
+		SendNotice(event.RoomID, "The move can't be changed because the game is over.")
+		return
+	}
+	if plies > moveEvent.Ply {
+		opponent := getDisplayName(event.RoomID, gameState.Player(positions[moveEvent.Ply].Turn()))
+		SendNotice(event.RoomID, fmt.Sprintf("The move can't be changed because %s has already replied.", opponent))
+		return
+	}
+
+	if err := takeBack(game); err != nil {
+		log.Errorf("Failed to take back the last move of game %s: %v", gameState.GameID, err)
+		return
+	}
+	if len(gameState.Evaluations) > plies {
+		gameState.Evaluations = gameState.Evaluations[:plies]
+	}
+	if !playMove(event, moveEvent.EventID, gameState, game, strings.TrimPrefix(body, "* ")) {
+		SendNotice(event.RoomID, "The edit isn't a legal move, so the move stands.")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/notnil/chess"
+	log "github.com/sirupsen/logrus"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// The reactions that answer a draw offer or a takeback request.
+const (
+	drawReaction    = "🤝"
+	acceptReaction  = "✅"
+	declineReaction = "❌"
+)
+
+// The kinds of offer that a player can make to their opponent.
+const (
+	OfferDraw     = "draw"
+	OfferTakeBack = "takeback"
+)
+
+// Offer is a draw offer or a takeback request that waits for the opponent to
+// react to its notice.
+type Offer struct {
+	Kind    string
+	From    mid.UserID
+	EventID mid.EventID
+
+	// Ply is the number of moves that had been played when the offer was
+	// made. The offer lapses once another move is played.
+	Ply int
+}
+
+// handleOfferCommand offers the opponent of the sender a draw, or asks them
+// to allow the sender's last move to be taken back.
+func handleOfferCommand(event *mevent.Event, kind string) {
+	gameState, err := getGameStateEvent(event.RoomID)
+	if err != nil {
+		SendNotice(event.RoomID, "There is no game being played.")
+		return
+	}
+	if gameState.Bughouse != nil || gameState.Vote != nil {
+		SendNotice(event.RoomID, "Draws and takebacks can only be offered in games between two players.")
+		return
+	}
+	game, err := gameState.parseGame()
+	if err != nil {
+		log.Errorf("Failed to parse game %s: %v", gameState.GameID, err)
+		return
+	}
+	if game.Outcome() != chess.NoOutcome {
+		SendNotice(event.RoomID, "The game is already over.")
+		return
+	}
+	var color chess.Color
+	switch event.Sender {
+	case gameState.White:
+		color = chess.White
+	case gameState.Black:
+		color = chess.Black
+	default:
+		SendNotice(event.RoomID, "Only the players can make offers.")
+		return
+	}
+	opponent := gameState.Player(color.Other())
+	if opponent == "" {
+		SendNotice(event.RoomID, fmt.Sprintf("Nobody is playing %s yet.", colorName(color.Other())))
+		return
+	}
+
+	sender, opponentName := getDisplayName(event.RoomID, event.Sender), getDisplayName(event.RoomID, opponent)
+	var notice string
+	if kind == OfferDraw {
+		notice = fmt.Sprintf("%s offers a draw. %s, react with %s to accept or %s to decline.", sender, opponentName, drawReaction, declineReaction)
+	} else {
+		// Only the last move can be taken back, so it has to be the
+		// sender's.
+		moves := game.Moves()
+		if len(moves) == 0 || game.Position().Turn() == color {
+			SendNotice(event.RoomID, "Only your last move can be taken back, before your opponent replies.")
+			return
+		}
+		notice = fmt.Sprintf("%s asks to take back %s. %s, react with %s to allow it or %s to refuse.", sender, moveSAN(game, len(moves)-1), opponentName, acceptReaction, declineReaction)
+	}
+
+	resp, err := SendNotice(event.RoomID, notice)
+	if err != nil {
+		return
+	}
+	gameState.Offer = &Offer{Kind: kind, From: event.Sender, EventID: resp.EventID, Ply: len(game.Moves())}
+	if _, err := saveGame(event.RoomID, game, gameState); err != nil {
+		log.Errorf("Failed to save game %s: %v", gameState.GameID, err)
+	}
+}
+
+// answerOffer accepts or declines the offer whose notice the reaction is on,
+// if the reaction comes from the opponent of the player who made it. It
+// returns false if the event isn't the notice of the current offer.
+func answerOffer(event *mevent.Event, eventID mid.EventID, key string) bool {
+	gameState, err := getGameStateEvent(event.RoomID)
+	if err != nil || gameState.Offer == nil || gameState.Offer.EventID != eventID {
+		return false
+	}
+	offer := gameState.Offer
+	if event.Sender == offer.From || (event.Sender != gameState.White && event.Sender != gameState.Black) {
+		return true
+	}
+	key = normalizeEmoji(key)
+	accepted := key == normalizeEmoji(acceptReaction) || offer.Kind == OfferDraw && key == normalizeEmoji(drawReaction)
+	if !accepted && key != normalizeEmoji(declineReaction) {
+		return true
+	}
+
+	game, err := gameState.parseGame()
+	if err != nil {
+		log.Errorf("Failed to parse game %s: %v", gameState.GameID, err)
+		return true
+	}
+	gameState.Offer = nil
+	var notice string
+	switch {
+	case len(game.Moves()) != offer.Ply || game.Outcome() != chess.NoOutcome:
+		notice = "The offer lapsed when the game moved on."
+	case !accepted && offer.Kind == OfferDraw:
+		notice = fmt.Sprintf("%s declines the draw.", getDisplayName(event.RoomID, event.Sender))
+	case !accepted:
+		notice = fmt.Sprintf("%s refuses the takeback.", getDisplayName(event.RoomID, event.Sender))
+	}
+	if notice != "" {
+		SendNotice(event.RoomID, notice)
+		if _, err := saveGame(event.RoomID, game, gameState); err != nil {
+			log.Errorf("Failed to save game %s: %v", gameState.GameID, err)
+		}
+		return true
+	}
+
+	if offer.Kind == OfferDraw {
+		if err := drawGame(game, chess.DrawOffer); err != nil {
+			log.Errorf("Failed to draw game %s: %v", gameState.GameID, err)
+			return true
+		}
+		if _, err := saveGame(event.RoomID, game, gameState); err != nil {
+			log.Errorf("Failed to save game %s: %v", gameState.GameID, err)
+			return true
+		}
+		SendNotice(event.RoomID, gameStatus(game))
+		finishGame(event.RoomID, gameState, game)
+		return true
+	}
+
+	if err := takeBack(game); err != nil {
+		log.Errorf("Failed to take back the last move of game %s: %v", gameState.GameID, err)
+		return true
+	}
+	if plies := len(game.Moves()); len(gameState.Evaluations) > plies+1 {
+		gameState.Evaluations = gameState.Evaluations[:plies+1]
+	}
+	showMove(event.RoomID, "", gameState, game)
+	return true
+}
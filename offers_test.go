@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/notnil/chess"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+func TestAnswerOffer(t *testing.T) {
+	roomID := mid.RoomID("!room:test")
+	alice, bob := mid.UserID("@alice:test"), mid.UserID("@bob:test")
+	testCases := []struct {
+		name     string
+		kind     string
+		reaction string
+		reactor  mid.UserID
+		moves    string
+		outcome  chess.Outcome
+	}{
+		{"draw accepted", OfferDraw, drawReaction, alice, "e4 e5", chess.Draw},
+		{"draw declined", OfferDraw, declineReaction, alice, "e4 e5", chess.NoOutcome},
+		{"draw accepted by the player who offered it", OfferDraw, drawReaction, bob, "e4 e5", chess.NoOutcome},
+		{"takeback allowed", OfferTakeBack, acceptReaction, alice, "e4", chess.NoOutcome},
+		{"takeback refused", OfferTakeBack, declineReaction, alice, "e4 e5", chess.NoOutcome},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			setUpTestApp(t)
+			handleNewCommand(roomID, []string{"casual"})
+			for i, move := range []string{"e4", "e5"} {
+				gameState, err := getGameStateEvent(roomID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				game, err := gameState.parseGame()
+				if err != nil {
+					t.Fatal(err)
+				}
+				sender := alice
+				if i%2 == 1 {
+					sender = bob
+				}
+				event := &mevent.Event{RoomID: roomID, Sender: sender, ID: mid.EventID("$" + move)}
+				if !playMove(event, event.ID, gameState, game, move) {
+					t.Fatalf("%s wasn't played", move)
+				}
+			}
+
+			handleOfferCommand(&mevent.Event{RoomID: roomID, Sender: bob}, tc.kind)
+			gameState, err := getGameStateEvent(roomID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gameState.Offer == nil {
+				t.Fatalf("the offer wasn't saved")
+			}
+			reaction := &mevent.Event{RoomID: roomID, Sender: tc.reactor}
+			if !answerOffer(reaction, gameState.Offer.EventID, tc.reaction) {
+				t.Fatalf("the reaction wasn't taken as an answer to the offer")
+			}
+
+			gameState, err = getGameStateEvent(roomID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			game, err := gameState.parseGame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if movetext := strings.Join(strings.Fields(pgnMovetext(gameState.PGN)), " "); !strings.HasPrefix(movetext, "1. "+tc.moves+" ") {
+				t.Errorf("saved PGN %q, want the moves 1. %s", gameState.PGN, tc.moves)
+			}
+			if game.Outcome() != tc.outcome {
+				t.Errorf("outcome %s, want %s", game.Outcome(), tc.outcome)
+			}
+			if tc.outcome == chess.Draw && drawMethod(game) != chess.DrawOffer {
+				t.Errorf("the game was drawn by %s, want an agreed draw", drawMethod(game))
+			}
+			if answered := tc.reactor != bob; answered != (gameState.Offer == nil) {
+				t.Errorf("offer %+v after the reaction, want it answered: %v", gameState.Offer, answered)
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/notnil/chess"
+	"github.com/notnil/chess/opening"
+)
+
+var (
+	ecoBook     *opening.BookECO
+	ecoBookOnce sync.Once
+)
+
+// findOpening returns the most specific named opening that the game follows,
+// or nil if it doesn't follow a known opening. The opening book takes a while
+// to build, so it is only loaded the first time it is needed.
+func findOpening(game Game) *opening.Opening {
+	if _, ok := game.(*VariantGame); ok || game.Positions()[0].String() != chess.StartingPosition().String() {
+		return nil
+	}
+	ecoBookOnce.Do(func() {
+		ecoBook = opening.NewBookECO()
+	})
+	return ecoBook.Find(game.Moves())
+}
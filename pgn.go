@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/notnil/chess"
+	log "github.com/sirupsen/logrus"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+
+	"github.com/nevarro-space/matrix-chessbot/store"
+)
+
+// pgnTagOrder is the order of the tags that the bot maintains, starting with
+// the Seven Tag Roster. Any other tags of a game come after these.
+var pgnTagOrder = []string{"Event", "Site", "Date", "Round", "White", "Black", "Result", "TimeControl", "ECO"}
+
+var pgnTagValueReplacer = strings.NewReplacer(`"`, "'", "\n", " ", "\\", "/")
+
+// setPGNTags sets the tag pairs of the game from its archive record. The Date
+// tag is only set if the game doesn't have one yet, as it records when the
+// game started.
+func setPGNTags(game Game, archived *store.ArchivedGame, displayName func(mid.UserID) string) {
+	kind := "Casual"
+	if archived.Rated {
+		kind = "Rated"
+	}
+	player := func(userID mid.UserID) string {
+		if userID == "" {
+			return "?"
+		}
+		return displayName(userID)
+	}
+	date := archived.StartedAt.Format("2006.01.02")
+	if tag := game.GetTagPair("Date"); tag != nil {
+		date = tag.Value
+	}
+	timeControl := archived.TimeControl
+	if timeControl == "" {
+		timeControl = "-"
+	}
+	eco := ""
+	if opening := findOpening(game); opening != nil {
+		eco = opening.Code()
+	}
+
+	values := map[string]string{
+		"Event":       fmt.Sprintf("%s %s game", kind, ratingPool(timeControl)),
+		"Site":        fmt.Sprintf("https://matrix.to/#/%s", archived.RoomID),
+		"Date":        date,
+		"Round":       "-",
+		"White":       player(archived.White),
+		"Black":       player(archived.Black),
+		"Result":      game.Outcome().String(),
+		"TimeControl": timeControl,
+		"ECO":         eco,
+	}
+
+	// Remove every tag and add them back in order, keeping any other tags
+	// after the ones maintained here.
+	others := make([]*chess.TagPair, 0)
+	for _, tag := range game.TagPairs() {
+		if _, ok := values[tag.Key]; !ok {
+			others = append(others, tag)
+		}
+		game.RemoveTagPair(tag.Key)
+	}
+	for _, key := range pgnTagOrder {
+		if values[key] != "" {
+			game.AddTagPair(key, pgnTagValueReplacer.Replace(values[key]))
+		}
+	}
+	for _, tag := range others {
+		game.AddTagPair(tag.Key, tag.Value)
+	}
+}
+
+// roomDisplayNames returns a function that looks up display names in the
+// room, remembering the names it has already looked up.
+func roomDisplayNames(roomID mid.RoomID) func(mid.UserID) string {
+	names := map[mid.UserID]string{}
+	return func(userID mid.UserID) string {
+		if name, ok := names[userID]; ok {
+			return name
+		}
+		names[userID] = getDisplayName(roomID, userID)
+		return names[userID]
+	}
+}
+
+// exportPGN returns the PGN of an archived game with a complete set of tags.
+func exportPGN(archived *store.ArchivedGame, displayName func(mid.UserID) string) (string, error) {
+	game, err := parseGamePGN(archived.PGN)
+	if err != nil {
+		return "", err
+	}
+	setPGNTags(game, archived, displayName)
+	return game.String(), nil
+}
+
+// handlePGNCommand uploads the PGN of games played in the room as a file.
+// Without arguments, or with "game", it exports the current game.
+func handlePGNCommand(event *mevent.Event, args []string) {
+	usage := "Usage: pgn [game|<game ID>|all|@user|since YYYY-MM-DD]"
+	args = nonEmpty(args)
+
+	var games []*store.ArchivedGame
+	filename := "games.pgn"
+	switch {
+	case len(args) == 0 || (len(args) == 1 && strings.ToLower(args[0]) == "game"):
+		gameState, err := getGameStateEvent(event.RoomID)
+		if err != nil || gameState.GameID == "" {
+			SendNotice(event.RoomID, "There is no game in this room.")
+			return
+		}
+		if game := App.gameStore.GetGame(gameState.GameID); game != nil {
+			games = append(games, game)
+		}
+		filename = fmt.Sprintf("game-%s.pgn", gameState.GameID)
+
+	case len(args) == 1 && strings.ToLower(args[0]) == "all":
+		games = App.gameStore.GetGamesInRoom(event.RoomID)
+
+	case len(args) == 1 && strings.HasPrefix(args[0], "@"):
+		userID := mid.UserID(args[0])
+		for _, game := range App.gameStore.GetGamesForPlayer(userID) {
+			if game.RoomID == event.RoomID {
+				games = append(games, game)
+			}
+		}
+
+	case len(args) == 2 && strings.ToLower(args[0]) == "since":
+		since, err := time.ParseInLocation("2006-01-02", args[1], time.Local)
+		if err != nil {
+			SendNotice(event.RoomID, usage)
+			return
+		}
+		for _, game := range App.gameStore.GetGamesInRoom(event.RoomID) {
+			if !game.StartedAt.Before(since) {
+				games = append(games, game)
+			}
+		}
+
+	case len(args) == 1:
+		// Games are only exported to the room they were played in.
+		if game := App.gameStore.GetGame(args[0]); game != nil && game.RoomID == event.RoomID {
+			games = append(games, game)
+		}
+		filename = fmt.Sprintf("game-%s.pgn", args[0])
+
+	default:
+		SendNotice(event.RoomID, usage)
+		return
+	}
+
+	if len(games) == 0 {
+		SendNotice(event.RoomID, "No games found.")
+		return
+	}
+
+	displayName := roomDisplayNames(event.RoomID)
+	exported := make([]string, 0, len(games))
+	for _, game := range games {
+		pgn, err := exportPGN(game, displayName)
+		if err != nil {
+			log.Errorf("Failed to export game %s: %v", game.ID, err)
+			continue
+		}
+		exported = append(exported, pgn)
+	}
+	data := []byte(strings.Join(exported, "\n\n") + "\n")
+	if _, err := SendFile(event.RoomID, data, "application/x-chess-pgn", filename); err != nil {
+		log.Errorf("Failed to send PGN file: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/notnil/chess"
+	log "github.com/sirupsen/logrus"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+
+	"github.com/nevarro-space/matrix-chessbot/store"
+)
+
+// pgnStartRegex matches the start of a PGN: any tag pairs followed by the
+// first move of the movetext.
+var pgnStartRegex = regexp.MustCompile(`(?:\[\w+\s+"[^"\n]*"\]\s*)*\b1\.\s*(?:[KQRBN]?[a-h]?[1-8]?x?[a-h][1-8]|O-O)`)
+
+var codeBlockRegex = regexp.MustCompile(`(?s)<code[^>]*>(.*?)</code>`)
+
+// parsePGNText returns the game in the first PGN in the text, or nil if
+// there isn't one. The PGN ends at the first blank line. A single move isn't
+// enough to count as a PGN, as it is probably just a move being discussed.
+func parsePGNText(text string) *chess.Game {
+	loc := pgnStartRegex.FindStringIndex(text)
+	if loc == nil {
+		return nil
+	}
+	text = text[loc[0]:]
+	if end := strings.Index(text[loc[1]-loc[0]:], "\n\n"); end >= 0 {
+		text = text[:loc[1]-loc[0]+end]
+	}
+
+	pgn, err := chess.PGN(strings.NewReader(text))
+	if err != nil {
+		log.Debugf("Ignoring text that looks like PGN but isn't: %v", err)
+		return nil
+	}
+	game := chess.NewGame(pgn)
+	if len(game.Moves()) < 2 {
+		return nil
+	}
+	return game
+}
+
+// findPGN returns the game in the first PGN in the message, looking in the
+// code blocks of the formatted body before the plain body.
+func findPGN(content *mevent.MessageEventContent) *chess.Game {
+	if content.Format == mevent.FormatHTML {
+		for _, match := range codeBlockRegex.FindAllStringSubmatch(content.FormattedBody, -1) {
+			if game := parsePGNText(html.UnescapeString(match[1])); game != nil {
+				return game
+			}
+		}
+	}
+	return parsePGNText(content.Body)
+}
+
+// sendPGNPosition replies in the thread of the message with the final
+// position of the game, or an animation of the whole game ending on the final
+// position if animations are enabled.
+func sendPGNPosition(roomID mid.RoomID, messageEventID mid.EventID, game *chess.Game) {
+	description := describePosition(game.Position(), lastMoveString(game))
+	if opening := findOpening(game); opening != nil {
+		description += fmt.Sprintf(" Opening: %s %s.", opening.Code(), opening.Title())
+	}
+
+	var uploaded *store.UploadedBoardImage
+	var err error
+	if App.configuration.AnimatePGN && len(game.Moves()) <= maxAnimatedPlies {
+		var animation *RenderedImage
+		if animation, err = RenderGameAnimation(game, DefaultBoardStyle()); err == nil {
+			uploaded, err = uploadImage(animation, "game.gif")
+		}
+	} else {
+		moves := game.Moves()
+		last := moves[len(moves)-1]
+		uploaded, err = uploadBoardImage(BoardRender{
+			Board:      game.Position().Board(),
+			Highlights: []chess.Square{last.S1(), last.S2()},
+			Style:      DefaultBoardStyle(),
+			Evaluation: evaluatePosition(game.Position()),
+		})
+	}
+	if err != nil {
+		log.Errorf("Failed to render PGN: %v", err)
+		return
+	}
+
+	resp, err := SendImage(roomID, uploaded, description, &messageEventID)
+	if err != nil {
+		log.Errorf("Failed to send board image: %v", err)
+		return
+	}
+	App.fenImageStore.SetEventID(roomID, messageEventID, resp.EventID)
+}
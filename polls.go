@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// The poll events of MSC3381. mautrix doesn't know them, so they are
+// registered with registerPollEventTypes. Responses are also accepted with
+// the unstable type that some clients still send.
+var (
+	EventPollStart            = mevent.Type{Type: "m.poll.start", Class: mevent.MessageEventType}
+	EventPollResponse         = mevent.Type{Type: "m.poll.response", Class: mevent.MessageEventType}
+	EventPollResponseUnstable = mevent.Type{Type: "org.matrix.msc3381.poll.response", Class: mevent.MessageEventType}
+	EventPollEnd              = mevent.Type{Type: "m.poll.end", Class: mevent.MessageEventType}
+)
+
+// TextContent is the m.text content block of extensible events.
+type TextContent struct {
+	Body string `json:"body"`
+}
+
+type PollAnswer struct {
+	ID   string        `json:"m.id"`
+	Text []TextContent `json:"m.text"`
+}
+
+type PollQuestion struct {
+	Text []TextContent `json:"m.text"`
+}
+
+type PollContent struct {
+	Kind          string       `json:"kind"`
+	MaxSelections int          `json:"max_selections"`
+	Question      PollQuestion `json:"question"`
+	Answers       []PollAnswer `json:"answers"`
+}
+
+type PollStartEventContent struct {
+	Text []TextContent `json:"m.text"`
+	Poll PollContent   `json:"m.poll"`
+}
+
+type PollResponseEventContent struct {
+	RelatesTo  mevent.RelatesTo `json:"m.relates_to"`
+	Selections []string         `json:"m.selections,omitempty"`
+
+	Unstable *struct {
+		Answers []string `json:"answers"`
+	} `json:"org.matrix.msc3381.poll.response,omitempty"`
+}
+
+type PollEndEventContent struct {
+	RelatesTo mevent.RelatesTo `json:"m.relates_to"`
+	Text      []TextContent    `json:"m.text"`
+}
+
+// registerPollEventTypes lets mautrix parse the content of poll events, which
+// the syncer drops otherwise.
+func registerPollEventTypes() {
+	mevent.TypeMap[EventPollStart] = reflect.TypeOf(PollStartEventContent{})
+	mevent.TypeMap[EventPollResponse] = reflect.TypeOf(PollResponseEventContent{})
+	mevent.TypeMap[EventPollResponseUnstable] = reflect.TypeOf(PollResponseEventContent{})
+	mevent.TypeMap[EventPollEnd] = reflect.TypeOf(PollEndEventContent{})
+}
+
+// SendPoll opens a poll where each member can choose one of the answers, and
+// sees the results as they come in.
+func SendPoll(roomID mid.RoomID, question string, answers []string) (*mautrix.RespSendEvent, error) {
+	content := PollStartEventContent{
+		Text: []TextContent{{Body: question}},
+		Poll: PollContent{
+			Kind:          "m.disclosed",
+			MaxSelections: 1,
+			Question:      PollQuestion{Text: []TextContent{{Body: question}}},
+		},
+	}
+	for _, answer := range answers {
+		content.Poll.Answers = append(content.Poll.Answers, PollAnswer{ID: answer, Text: []TextContent{{Body: answer}}})
+	}
+	r, err := DoRetry(fmt.Sprintf("send poll to %s", roomID), func() (interface{}, error) {
+		eventType, encrypted, err := encryptEventContent(roomID, EventPollStart, &content, nil)
+		if err != nil {
+			return nil, err
+		}
+		return App.client.SendMessageEvent(roomID, eventType, encrypted)
+	})
+	if err != nil {
+		log.Errorf("Failed to send poll to %s: %s", roomID, err)
+		return nil, err
+	}
+	return r.(*mautrix.RespSendEvent), err
+}
+
+// EndPoll closes the poll, saying how it ended.
+func EndPoll(roomID mid.RoomID, pollEventID mid.EventID, text string) (*mautrix.RespSendEvent, error) {
+	content := PollEndEventContent{
+		RelatesTo: mevent.RelatesTo{Type: mevent.RelReference, EventID: pollEventID},
+		Text:      []TextContent{{Body: text}},
+	}
+	r, err := DoRetry(fmt.Sprintf("end poll in %s", roomID), func() (interface{}, error) {
+		eventType, encrypted, err := encryptEventContent(roomID, EventPollEnd, &content, &content.RelatesTo)
+		if err != nil {
+			return nil, err
+		}
+		return App.client.SendMessageEvent(roomID, eventType, encrypted)
+	})
+	if err != nil {
+		log.Errorf("Failed to end poll in %s: %s", roomID, err)
+		return nil, err
+	}
+	return r.(*mautrix.RespSendEvent), err
+}
+
+func HandlePollResponse(source mautrix.EventSource, event *mevent.Event) {
+	if event.Sender.String() == App.configuration.Username {
+		return
+	}
+
+	content, ok := event.Content.Parsed.(*PollResponseEventContent)
+	if !ok || content.RelatesTo.Type != mevent.RelReference {
+		return
+	}
+	selections := content.Selections
+	if content.Unstable != nil {
+		selections = content.Unstable.Answers
+	}
+	if len(selections) == 0 {
+		return
+	}
+	handleVote(event.RoomID, content.RelatesTo.EventID, event.Sender, selections[0])
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/notnil/chess"
+	log "github.com/sirupsen/logrus"
+	mid "maunium.net/go/mautrix/id"
+
+	"github.com/nevarro-space/matrix-chessbot/store"
+)
+
+// Rating pools. Games are rated in the pool for their time control, and games
+// without a time control are correspondence games.
+const (
+	PoolBullet         = "bullet"
+	PoolBlitz          = "blitz"
+	PoolRapid          = "rapid"
+	PoolCorrespondence = "correspondence"
+)
+
+var RatingPools = []string{PoolBullet, PoolBlitz, PoolRapid, PoolCorrespondence}
+
+func isRatingPool(pool string) bool {
+	for _, p := range RatingPools {
+		if p == pool {
+			return true
+		}
+	}
+	return false
+}
+
+// provisionalDeviation is the rating deviation above which a rating is
+// considered provisional.
+const provisionalDeviation = 110
+
+var timeControlRegex = regexp.MustCompile(`^(\d+)(?:\+(\d+))?$`)
+
+// parseTimeControl parses a time control of the form "minutes+increment"
+// (for example "5+3") into the PGN TimeControl format ("300+3").
+func parseTimeControl(s string) (string, bool) {
+	match := timeControlRegex.FindStringSubmatch(s)
+	if match == nil {
+		return "", false
+	}
+	minutes, _ := strconv.Atoi(match[1])
+	if minutes == 0 {
+		return "", false
+	}
+	if match[2] == "" {
+		return strconv.Itoa(minutes * 60), true
+	}
+	return fmt.Sprintf("%d+%s", minutes*60, match[2]), true
+}
+
+// ratingPool returns the pool for games with the given PGN time control. The
+// pool is chosen by the estimated game duration, assuming 40 moves.
+func ratingPool(timeControl string) string {
+	var base, increment int
+	if _, err := fmt.Sscanf(timeControl, "%d+%d", &base, &increment); err != nil {
+		if _, err := fmt.Sscanf(timeControl, "%d", &base); err != nil {
+			return PoolCorrespondence
+		}
+	}
+	estimate := time.Duration(base+40*increment) * time.Second
+	switch {
+	case estimate < 3*time.Minute:
+		return PoolBullet
+	case estimate < 8*time.Minute:
+		return PoolBlitz
+	default:
+		return PoolRapid
+	}
+}
+
+func isProvisional(rating *store.Rating) bool {
+	return rating.Deviation > provisionalDeviation
+}
+
+func formatRating(rating *store.Rating) string {
+	if isProvisional(rating) {
+		return fmt.Sprintf("%.0f?", rating.Rating)
+	}
+	return fmt.Sprintf("%.0f", rating.Rating)
+}
+
+// Glicko-2 system constants. The system constant tau constrains how much the
+// volatility can change.
+const (
+	glickoScale   = 173.7178
+	glickoTau     = 0.5
+	glickoEpsilon = 0.000001
+)
+
+func glickoG(phi float64) float64 {
+	return 1 / math.Sqrt(1+3*phi*phi/(math.Pi*math.Pi))
+}
+
+// glickoResult is the result of a game against the opponent. The score is 1
+// for a win, 0.5 for a draw and 0 for a loss.
+type glickoResult struct {
+	opponent *store.Rating
+	score    float64
+}
+
+// glicko2Update returns the player's new rating after the games of a rating
+// period. The bot treats every game as its own rating period.
+func glicko2Update(player *store.Rating, results []glickoResult) (rating, deviation, volatility float64) {
+	mu := (player.Rating - store.DefaultRating) / glickoScale
+	phi := player.Deviation / glickoScale
+	sigma := player.Volatility
+
+	// improvement is the sum that the rating improvement is estimated from.
+	var vInverse, improvement float64
+	for _, result := range results {
+		muJ := (result.opponent.Rating - store.DefaultRating) / glickoScale
+		g := glickoG(result.opponent.Deviation / glickoScale)
+		expected := 1 / (1 + math.Exp(-g*(mu-muJ)))
+		vInverse += g * g * expected * (1 - expected)
+		improvement += g * (result.score - expected)
+	}
+	v := 1 / vInverse
+	delta := v * improvement
+
+	// Find the new volatility using the Illinois algorithm.
+	a := math.Log(sigma * sigma)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		return ex*(delta*delta-phi*phi-v-ex)/(2*math.Pow(phi*phi+v+ex, 2)) - (x-a)/(glickoTau*glickoTau)
+	}
+	A := a
+	var B float64
+	if delta*delta > phi*phi+v {
+		B = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*glickoTau) < 0 {
+			k++
+		}
+		B = a - k*glickoTau
+	}
+	fA, fB := f(A), f(B)
+	for math.Abs(B-A) > glickoEpsilon {
+		C := A + (A-B)*fA/(fB-fA)
+		fC := f(C)
+		if fC*fB <= 0 {
+			A, fA = B, fB
+		} else {
+			fA /= 2
+		}
+		B, fB = C, fC
+	}
+	newSigma := math.Exp(A / 2)
+
+	phiStar := math.Sqrt(phi*phi + newSigma*newSigma)
+	newPhi := 1 / math.Sqrt(1/(phiStar*phiStar)+1/v)
+	newMu := mu + newPhi*newPhi*improvement
+
+	deviation = math.Min(newPhi*glickoScale, store.DefaultDeviation)
+	return newMu*glickoScale + store.DefaultRating, deviation, newSigma
+}
+
+// updateRatings updates the ratings of both players after a rated game has
+// finished, and returns a summary of the changes. It returns an empty string
+// if the game doesn't count for ratings.
+func updateRatings(gameState *StateChessGameEventContent, outcome chess.Outcome) string {
+	if !gameState.Rated || gameState.White == "" || gameState.Black == "" || gameState.White == gameState.Black {
+		return ""
+	}
+	var whiteScore float64
+	switch outcome {
+	case chess.WhiteWon:
+		whiteScore = 1
+	case chess.BlackWon:
+		whiteScore = 0
+	case chess.Draw:
+		whiteScore = 0.5
+	default:
+		return ""
+	}
+
+	pool := ratingPool(gameState.TimeControl)
+	white := App.ratingStore.GetRating(gameState.White, pool)
+	black := App.ratingStore.GetRating(gameState.Black, pool)
+	oldWhite, oldBlack := *white, *black
+
+	now := time.Now()
+	update := func(rating, opponent *store.Rating, score float64) {
+		rating.Rating, rating.Deviation, rating.Volatility = glicko2Update(rating, []glickoResult{{opponent: opponent, score: score}})
+		rating.Games++
+		switch score {
+		case 1:
+			rating.Wins++
+		case 0:
+			rating.Losses++
+		default:
+			rating.Draws++
+		}
+		rating.UpdatedAt = now
+	}
+	update(white, &oldBlack, whiteScore)
+	update(black, &oldWhite, 1-whiteScore)
+
+	for _, rating := range []*store.Rating{white, black} {
+		if err := App.ratingStore.SetRating(rating); err != nil {
+			log.Errorf("Failed to save %s rating for %s: %v", pool, rating.UserID, err)
+		}
+	}
+
+	change := func(userID mid.UserID, before, after *store.Rating) string {
+		return fmt.Sprintf("%s: %s → %s (%+.0f)", userID, formatRating(before), formatRating(after), after.Rating-before.Rating)
+	}
+	return fmt.Sprintf("Rated %s game. %s, %s.", pool,
+		change(gameState.White, &oldWhite, white),
+		change(gameState.Black, &oldBlack, black))
+}
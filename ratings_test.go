@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/nevarro-space/matrix-chessbot/store"
+)
+
+func TestGlicko2Update(t *testing.T) {
+	testCases := []struct {
+		name       string
+		player     store.Rating
+		results    []glickoResult
+		rating     float64
+		deviation  float64
+		volatility float64
+	}{
+		{
+			// The example in Glickman's "Example of the Glicko-2 system".
+			name:   "Glickman's example",
+			player: store.Rating{Rating: 1500, Deviation: 200, Volatility: 0.06},
+			results: []glickoResult{
+				{opponent: &store.Rating{Rating: 1400, Deviation: 30}, score: 1},
+				{opponent: &store.Rating{Rating: 1550, Deviation: 100}, score: 0},
+				{opponent: &store.Rating{Rating: 1700, Deviation: 300}, score: 0},
+			},
+			rating:     1464.06,
+			deviation:  151.52,
+			volatility: 0.05999,
+		},
+		{
+			name:   "draw between new players",
+			player: store.Rating{Rating: 1500, Deviation: 350, Volatility: 0.06},
+			results: []glickoResult{
+				{opponent: &store.Rating{Rating: 1500, Deviation: 350}, score: 0.5},
+			},
+			rating:     1500,
+			deviation:  290.32,
+			volatility: 0.06,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rating, deviation, volatility := glicko2Update(&tc.player, tc.results)
+			if math.Abs(rating-tc.rating) > 0.01 {
+				t.Errorf("rating = %.4f, want %.2f", rating, tc.rating)
+			}
+			if math.Abs(deviation-tc.deviation) > 0.01 {
+				t.Errorf("deviation = %.4f, want %.2f", deviation, tc.deviation)
+			}
+			if math.Abs(volatility-tc.volatility) > 0.00001 {
+				t.Errorf("volatility = %.6f, want %.5f", volatility, tc.volatility)
+			}
+		})
+	}
+}
+
+func TestParseTimeControl(t *testing.T) {
+	testCases := []struct {
+		s           string
+		timeControl string
+		ok          bool
+	}{
+		{"5+3", "300+3", true},
+		{"10", "600", true},
+		{"1+0", "60+0", true},
+		{"90+30", "5400+30", true},
+		{"0+1", "", false},
+		{"5+", "", false},
+		{"+3", "", false},
+		{"5+3+1", "", false},
+		{"rated", "", false},
+		{"", "", false},
+	}
+	for _, tc := range testCases {
+		timeControl, ok := parseTimeControl(tc.s)
+		if timeControl != tc.timeControl || ok != tc.ok {
+			t.Errorf("parseTimeControl(%q) = %q, %v, want %q, %v", tc.s, timeControl, ok, tc.timeControl, tc.ok)
+		}
+	}
+}
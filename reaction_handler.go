@@ -0,0 +1,42 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"maunium.net/go/mautrix"
+	mevent "maunium.net/go/mautrix/event"
+)
+
+// flipReaction is the reaction that flips the board of the current game.
+const flipReaction = "🔄"
+
+func HandleReaction(source mautrix.EventSource, event *mevent.Event) {
+	if event.Sender.String() == App.configuration.Username {
+		return
+	}
+
+	relatesTo := event.Content.AsReaction().RelatesTo
+	if relatesTo.Type != mevent.RelAnnotation {
+		return
+	}
+
+	if replay := App.replayStore.GetReplay(event.RoomID, relatesTo.EventID); replay != nil {
+		if command, ok := replayReactionCommand(relatesTo.Key); ok {
+			navigateReplay(replay, []string{command})
+			// Each member can only react with a key once, so the reaction is
+			// taken away again to let them take another step with it. This
+			// needs the power level to redact other members' events.
+			if _, err := App.client.RedactEvent(event.RoomID, event.ID); err != nil {
+				log.Debugf("Failed to redact replay reaction %s: %v", event.ID, err)
+			}
+		}
+		return
+	}
+
+	if answerOffer(event, relatesTo.EventID, relatesTo.Key) {
+		return
+	}
+
+	if normalizeEmoji(relatesTo.Key) == normalizeEmoji(flipReaction) {
+		flipBoard(event.RoomID, relatesTo.EventID)
+	}
+}
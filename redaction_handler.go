@@ -0,0 +1,19 @@
+package main
+
+import (
+	"maunium.net/go/mautrix"
+	mevent "maunium.net/go/mautrix/event"
+)
+
+// HandleRedaction redacts the board image that was sent in reply to a FEN or
+// PGN when the message containing it is redacted.
+func HandleRedaction(source mautrix.EventSource, event *mevent.Event) {
+	if event.Sender.String() == App.configuration.Username {
+		return
+	}
+
+	boardEventID := App.fenImageStore.GetEventID(event.RoomID, event.Redacts)
+	if boardEventID.String() != "" {
+		App.client.RedactEvent(event.RoomID, boardEventID)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/notnil/chess"
+	log "github.com/sirupsen/logrus"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+
+	"github.com/nevarro-space/matrix-chessbot/store"
+)
+
+// replayContext is how many plies either side of the current one are shown
+// in the move list of a replay.
+const replayContext = 6
+
+// replayReactions are the reactions that the bot adds to replays, in order,
+// and the navigation command that each of them stands for.
+var replayReactions = []struct {
+	Key     string
+	Command string
+}{
+	{"⏮️", "first"},
+	{"⬅️", "prev"},
+	{"➡️", "next"},
+	{"⏭️", "last"},
+}
+
+// replayLock serialises navigation so that quick successive reactions don't
+// lose steps.
+var replayLock sync.Mutex
+
+var gotoRegex = regexp.MustCompile(`^(\d+)([wb]?)$`)
+
+// normalizeEmoji strips the variation selector that some clients add to
+// emoji and others don't.
+func normalizeEmoji(key string) string {
+	return strings.ReplaceAll(key, "\ufe0f", "")
+}
+
+// moveLabel returns the move number label for a move played from the
+// position, for example "12." for White or "12..." for Black.
+func moveLabel(position *chess.Position) string {
+	if position.Turn() == chess.White {
+		return fmt.Sprintf("%d.", moveNumber(position))
+	}
+	return fmt.Sprintf("%d...", moveNumber(position))
+}
+
+// replayMoveList returns the moves around the ply in SAN, with the move that
+// led to the ply in brackets.
+func replayMoveList(game Game, ply int) string {
+	positions, moves := game.Positions(), game.Moves()
+	from, to := ply-replayContext, ply+replayContext
+	if from < 0 {
+		from = 0
+	}
+	if to > len(moves) {
+		to = len(moves)
+	}
+
+	parts := make([]string, 0)
+	if from > 0 {
+		parts = append(parts, "…")
+	}
+	for i := from; i < to; i++ {
+		san := annotatedSAN(game, i)
+		if i+1 == ply {
+			san = "[" + san + "]"
+		}
+		if positions[i].Turn() == chess.White {
+			parts = append(parts, fmt.Sprintf("%d. %s", moveNumber(positions[i]), san))
+		} else if i == from {
+			parts = append(parts, fmt.Sprintf("%s %s", moveLabel(positions[i]), san))
+		} else {
+			parts = append(parts, san)
+		}
+	}
+	if to < len(moves) {
+		parts = append(parts, "…")
+	}
+	return strings.Join(parts, " ")
+}
+
+// replayCaption describes the ply of the game being replayed.
+func replayCaption(game Game, ply int) string {
+	positions, moves := game.Positions(), game.Moves()
+	var caption strings.Builder
+	fmt.Fprintf(&caption, "Replay of %s (%s). ", gameTitle(game), game.Outcome())
+	if ply == 0 {
+		fmt.Fprintf(&caption, "Starting position, %s to move.", colorName(positions[0].Turn()))
+	} else {
+		san := annotatedSAN(game, ply-1)
+		fmt.Fprintf(&caption, "After %s %s, move %d of %d.", moveLabel(positions[ply-1]), san, ply, len(moves))
+	}
+	if len(moves) > 0 {
+		fmt.Fprintf(&caption, "\n%s", replayMoveList(game, ply))
+	}
+	if comments := game.Comments(); ply > 0 && ply <= len(comments) && len(comments[ply-1]) > 0 {
+		fmt.Fprintf(&caption, "\nComment: %s", strings.Join(comments[ply-1], " "))
+	}
+	caption.WriteString("\nSend next, prev, first, last or goto 23b in the thread, or react with ⏮️ ⬅️ ➡️ ⏭️.")
+	return caption.String()
+}
+
+// replayRender returns the render of the game at the ply.
+func replayRender(game Game, ply int) BoardRender {
+	positions, moves := game.Positions(), game.Moves()
+	annotations := BoardAnnotations{MoveNumber: moveNumber(positions[ply])}
+	if tag := game.GetTagPair("White"); tag != nil && tag.Value != "?" {
+		annotations.WhiteName = tag.Value
+	}
+	if tag := game.GetTagPair("Black"); tag != nil && tag.Value != "?" {
+		annotations.BlackName = tag.Value
+	}
+	annotations.CapturedByWhite, annotations.CapturedByBlack = capturedPieces(positions[:ply], moves[:ply])
+	setVariantAnnotations(&annotations, game, ply)
+
+	render := BoardRender{
+		Board:       positions[ply].Board(),
+		Style:       DefaultBoardStyle(),
+		Annotations: &annotations,
+	}
+	if ply > 0 {
+		render.Highlights = []chess.Square{moves[ply-1].S1(), moves[ply-1].S2()}
+	}
+	return render
+}
+
+// gotoPly returns the ply after the move given as a move number and an
+// optional colour, for example "23b" for Black's 23rd move.
+func gotoPly(game Game, target string) (int, bool) {
+	match := gotoRegex.FindStringSubmatch(strings.ToLower(target))
+	if match == nil {
+		return 0, false
+	}
+	number, _ := strconv.Atoi(match[1])
+	color := chess.White
+	if match[2] == "b" {
+		color = chess.Black
+	}
+	positions := game.Positions()
+	for i := range game.Moves() {
+		if moveNumber(positions[i]) == number && positions[i].Turn() == color {
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// replayTarget returns the ply that the navigation command moves the replay
+// to, and whether the command was a navigation command.
+func replayTarget(game Game, ply int, command []string) (int, bool) {
+	if len(command) == 0 {
+		return 0, false
+	}
+	last := len(game.Moves())
+	switch strings.ToLower(command[0]) {
+	case "next", "forward":
+		if ply < last {
+			ply++
+		}
+	case "prev", "previous", "back":
+		if ply > 0 {
+			ply--
+		}
+	case "first", "start":
+		ply = 0
+	case "last", "end":
+		ply = last
+	case "goto":
+		if len(command) != 2 {
+			return 0, false
+		}
+		return gotoPly(game, command[1])
+	default:
+		return 0, false
+	}
+	return ply, true
+}
+
+// loadReplayGame returns the game to replay given an archived game ID or an
+// imported game ID, or the current game of the room if the ID is empty.
+func loadReplayGame(roomID mid.RoomID, gameID string) (Game, error) {
+	if gameID == "" {
+		gameState, err := getGameStateEvent(roomID)
+		if err != nil || gameState.GameID == "" {
+			return nil, fmt.Errorf("there is no game in this room")
+		}
+		gameID = gameState.GameID
+	}
+
+	var pgn string
+	if archived := App.gameStore.GetGame(gameID); archived != nil && archived.RoomID == roomID {
+		exported, err := exportPGN(archived, roomDisplayNames(roomID))
+		if err != nil {
+			return nil, err
+		}
+		pgn = exported
+	} else if imported := App.importedGameStore.GetImportedGame(gameID); imported != nil && imported.RoomID == roomID {
+		pgn = imported.PGN
+	} else {
+		return nil, fmt.Errorf("there is no game %s in this room", gameID)
+	}
+
+	return parseGamePGN(pgn)
+}
+
+// handleReplayCommand posts the starting position of a game as a board image
+// that can be stepped through.
+func handleReplayCommand(event *mevent.Event, args []string) {
+	args = nonEmpty(args)
+	if len(args) > 1 {
+		SendNotice(event.RoomID, "Usage: replay [game ID]")
+		return
+	}
+	gameID := ""
+	if len(args) == 1 {
+		gameID = args[0]
+	}
+	game, err := loadReplayGame(event.RoomID, gameID)
+	if err != nil {
+		SendNotice(event.RoomID, fmt.Sprintf("Can't replay the game: %v.", err))
+		return
+	}
+
+	resp, err := SendBoardImage(event.RoomID, replayRender(game, 0), replayCaption(game, 0), nil)
+	if err != nil {
+		log.Errorf("Failed to send replay: %v", err)
+		return
+	}
+	replay := store.Replay{RoomID: event.RoomID, EventID: resp.EventID, PGN: game.String()}
+	if err := App.replayStore.SetReplay(&replay); err != nil {
+		log.Errorf("Failed to save replay: %v", err)
+		return
+	}
+	for _, reaction := range replayReactions {
+		SendReaction(event.RoomID, resp.EventID, reaction.Key)
+	}
+}
+
+// navigateReplay moves the replay according to the command and edits its
+// board image. It returns false if the command isn't a navigation command.
+func navigateReplay(replay *store.Replay, command []string) bool {
+	replayLock.Lock()
+	defer replayLock.Unlock()
+
+	// Re-read the replay now that we hold the lock, in case it moved.
+	if current := App.replayStore.GetReplay(replay.RoomID, replay.EventID); current != nil {
+		replay = current
+	}
+	game, err := parseGamePGN(replay.PGN)
+	if err != nil {
+		log.Errorf("Failed to parse replay %s: %v", replay.EventID, err)
+		return false
+	}
+	ply, ok := replayTarget(game, replay.Ply, command)
+	if !ok {
+		return false
+	}
+	if ply == replay.Ply {
+		return true
+	}
+
+	uploaded, err := uploadBoardImage(replayRender(game, ply))
+	if err != nil {
+		log.Errorf("Failed to render replay: %v", err)
+		return true
+	}
+	if _, err := EditImage(replay.RoomID, replay.EventID, uploaded, replayCaption(game, ply)); err != nil {
+		return true
+	}
+	replay.Ply = ply
+	if err := App.replayStore.SetReplay(replay); err != nil {
+		log.Errorf("Failed to save replay: %v", err)
+	}
+	return true
+}
+
+// replayReactionCommand returns the navigation command for a reaction to a
+// replay.
+func replayReactionCommand(key string) (string, bool) {
+	for _, reaction := range replayReactions {
+		if normalizeEmoji(reaction.Key) == normalizeEmoji(key) {
+			return reaction.Command, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/notnil/chess"
+)
+
+// StandardGame is a game of standard chess played with notnil/chess, along
+// with the NAGs and comments of its moves. notnil/chess can read comments
+// from a PGN but can't add them to a game, and it skips NAGs.
+type StandardGame struct {
+	*chess.Game
+	nags     [][]int
+	comments [][]string
+}
+
+// parseStandardPGN parses the PGN of a game of standard chess, keeping the
+// NAGs and comments of the moves of its main line.
+func parseStandardPGN(pgn string) (*StandardGame, error) {
+	parsed, err := chess.PGN(strings.NewReader(pgn))
+	if err != nil {
+		return nil, err
+	}
+	game := &StandardGame{Game: chess.NewGame(parsed)}
+	plies := len(game.Moves())
+	game.nags, game.comments = make([][]int, plies), make([][]string, plies)
+
+	ply := -1
+	for _, token := range variantTokenRegex.FindAllStringSubmatch(pgnMovetext(pgn), -1) {
+		switch {
+		case token[2] != "":
+			return game, nil
+		case token[3] != "":
+			ply++
+			if _, nag := splitGlyph(token[3]); nag != 0 && ply < plies {
+				game.nags[ply] = append(game.nags[ply], nag)
+			}
+		case ply < 0 || ply >= plies:
+			// Nothing before the first move or after the last one belongs
+			// to a move.
+		case strings.HasPrefix(token[0], "{"):
+			game.comments[ply] = append(game.comments[ply], strings.TrimSpace(token[1]))
+		default:
+			if nag, ok := parseNAG(token[0]); ok {
+				game.nags[ply] = append(game.nags[ply], nag)
+			}
+		}
+	}
+	return game, nil
+}
+
+// MoveStr plays the move written in SAN.
+func (g *StandardGame) MoveStr(s string) error {
+	if err := g.Game.MoveStr(s); err != nil {
+		return err
+	}
+	g.nags = append(g.nags, nil)
+	g.comments = append(g.comments, nil)
+	return nil
+}
+
+func (g *StandardGame) Comments() [][]string {
+	return append([][]string(nil), g.comments...)
+}
+
+// String returns the PGN of the game. Unlike notnil/chess, it writes the
+// NAGs of the moves, and numbers the moves from the move number of the
+// starting position.
+func (g *StandardGame) String() string {
+	var pgn strings.Builder
+	for _, tag := range g.TagPairs() {
+		fmt.Fprintf(&pgn, "[%s \"%s\"]\n", tag.Key, tag.Value)
+	}
+	pgn.WriteString("\n")
+	positions, moves := g.Positions(), g.Moves()
+	sans := make([]string, 0, len(moves))
+	for i, move := range moves {
+		sans = append(sans, chess.AlgebraicNotation{}.Encode(positions[i], move))
+	}
+	writeMovetext(&pgn, positions, sans, g.nags, g.comments, g.Outcome())
+	return pgn.String()
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+
+	"github.com/notnil/chess"
+	log "github.com/sirupsen/logrus"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+
+	"github.com/nevarro-space/matrix-chessbot/store"
+)
+
+const favouriteOpenings = 3
+
+// record is a tally of game results from one player's point of view.
+type record struct {
+	Wins, Draws, Losses int
+}
+
+func (r record) Games() int {
+	return r.Wins + r.Draws + r.Losses
+}
+
+func (r *record) addRecord(other record) {
+	r.Wins += other.Wins
+	r.Draws += other.Draws
+	r.Losses += other.Losses
+}
+
+// addResult counts the PGN result of a game that was played as the given
+// colour.
+func (r *record) addResult(result string, color chess.Color) {
+	switch {
+	case result == chess.Draw.String():
+		r.Draws++
+	case (result == chess.WhiteWon.String()) == (color == chess.White):
+		r.Wins++
+	default:
+		r.Losses++
+	}
+}
+
+type playerStats struct {
+	White, Black record
+	// Openings counts the games by the opening that was played.
+	Openings      map[string]int
+	Plies         int
+	LongestStreak int
+}
+
+// finishedGames returns the finished games that the user played against
+// somebody else, oldest first. Games against the engine leave one of the
+// players empty, and don't count, as in updateRatings.
+func finishedGames(userID mid.UserID) []*store.ArchivedGame {
+	games := make([]*store.ArchivedGame, 0)
+	for _, game := range App.gameStore.GetGamesForPlayer(userID) {
+		if game.Result != chess.NoOutcome.String() && game.White != "" && game.Black != "" && game.White != game.Black {
+			games = append(games, game)
+		}
+	}
+	return games
+}
+
+// computeStats computes the statistics of the user over the games, which
+// should all have been played by the user and be ordered oldest first.
+func computeStats(userID mid.UserID, games []*store.ArchivedGame) playerStats {
+	stats := playerStats{Openings: map[string]int{}}
+	streak := 0
+	for _, archived := range games {
+		color := chess.White
+		if archived.Black == userID {
+			color = chess.Black
+		}
+		var result record
+		result.addResult(archived.Result, color)
+		if color == chess.White {
+			stats.White.addRecord(result)
+		} else {
+			stats.Black.addRecord(result)
+		}
+
+		if result.Wins > 0 {
+			streak++
+			if streak > stats.LongestStreak {
+				stats.LongestStreak = streak
+			}
+		} else {
+			streak = 0
+		}
+
+		game, err := parseGamePGN(archived.PGN)
+		if err != nil {
+			log.Errorf("Failed to parse the PGN of game %s: %v", archived.ID, err)
+			continue
+		}
+		stats.Plies += len(game.Moves())
+		if opening := findOpening(game); opening != nil {
+			stats.Openings[fmt.Sprintf("%s %s", opening.Code(), opening.Title())]++
+		}
+	}
+	return stats
+}
+
+// topOpenings returns the most played openings, most played first.
+func (s playerStats) topOpenings() []string {
+	openings := make([]string, 0, len(s.Openings))
+	for opening := range s.Openings {
+		openings = append(openings, opening)
+	}
+	sort.Slice(openings, func(i, j int) bool {
+		if s.Openings[openings[i]] != s.Openings[openings[j]] {
+			return s.Openings[openings[i]] > s.Openings[openings[j]]
+		}
+		return openings[i] < openings[j]
+	})
+	if len(openings) > favouriteOpenings {
+		openings = openings[:favouriteOpenings]
+	}
+	return openings
+}
+
+// statsMessage builds a notice with the same content as plain text and as
+// HTML tables.
+type statsMessage struct {
+	text, html strings.Builder
+}
+
+func (m *statsMessage) heading(title string) {
+	fmt.Fprintf(&m.text, "%s\n", title)
+	fmt.Fprintf(&m.html, "<b>%s</b>\n", html.EscapeString(title))
+}
+
+func (m *statsMessage) line(text string) {
+	fmt.Fprintf(&m.text, "%s\n", text)
+	fmt.Fprintf(&m.html, "%s<br>\n", html.EscapeString(text))
+}
+
+func (m *statsMessage) recordTable(white, black record) {
+	var total record
+	total.addRecord(white)
+	total.addRecord(black)
+	m.html.WriteString("<table>\n<tr><th>As</th><th>Games</th><th>Wins</th><th>Draws</th><th>Losses</th></tr>\n")
+	for _, row := range []struct {
+		name   string
+		record record
+	}{{"White", white}, {"Black", black}, {"Total", total}} {
+		r := row.record
+		fmt.Fprintf(&m.text, "%s: %d games, +%d =%d -%d\n", row.name, r.Games(), r.Wins, r.Draws, r.Losses)
+		fmt.Fprintf(&m.html, "<tr><td>%s</td><td>%d</td><td>%d</td><td>%d</td><td>%d</td></tr>\n",
+			row.name, r.Games(), r.Wins, r.Draws, r.Losses)
+	}
+	m.html.WriteString("</table>\n")
+}
+
+func (m *statsMessage) send(roomID mid.RoomID) {
+	SendMessage(roomID, &mevent.MessageEventContent{
+		MsgType:       mevent.MsgNotice,
+		Body:          strings.TrimSpace(m.text.String()),
+		Format:        mevent.FormatHTML,
+		FormattedBody: strings.TrimSpace(m.html.String()),
+	})
+}
+
+// handleStatsCommand reports the statistics of a player, defaulting to the
+// sender, and optionally their results against an opponent.
+func handleStatsCommand(event *mevent.Event, args []string) {
+	usage := "Usage: stats [@user] [vs @user]"
+	userID := event.Sender
+	var opponent mid.UserID
+	args = nonEmpty(args)
+	if len(args) > 0 && strings.HasPrefix(args[0], "@") {
+		userID = mid.UserID(args[0])
+		args = args[1:]
+	}
+	switch {
+	case len(args) == 2 && strings.ToLower(args[0]) == "vs" && strings.HasPrefix(args[1], "@"):
+		opponent = mid.UserID(args[1])
+	case len(args) != 0:
+		SendNotice(event.RoomID, usage)
+		return
+	}
+
+	games := finishedGames(userID)
+	name := getDisplayName(event.RoomID, userID)
+	if len(games) == 0 {
+		SendNotice(event.RoomID, fmt.Sprintf("%s hasn't finished any games yet.", name))
+		return
+	}
+	stats := computeStats(userID, games)
+
+	var message statsMessage
+	message.heading(fmt.Sprintf("Statistics for %s", name))
+	message.recordTable(stats.White, stats.Black)
+	message.line(fmt.Sprintf("Average game length: %.1f moves", float64(stats.Plies)/2/float64(len(games))))
+	message.line(fmt.Sprintf("Longest win streak: %d", stats.LongestStreak))
+
+	if openings := stats.topOpenings(); len(openings) > 0 {
+		message.heading("Favourite openings")
+		message.html.WriteString("<table>\n<tr><th>Opening</th><th>Games</th></tr>\n")
+		for _, opening := range openings {
+			fmt.Fprintf(&message.text, "%s: %d games\n", opening, stats.Openings[opening])
+			fmt.Fprintf(&message.html, "<tr><td>%s</td><td>%d</td></tr>\n", html.EscapeString(opening), stats.Openings[opening])
+		}
+		message.html.WriteString("</table>\n")
+	}
+
+	if opponent != "" {
+		headToHead := make([]*store.ArchivedGame, 0)
+		for _, game := range games {
+			if game.White == opponent || game.Black == opponent {
+				headToHead = append(headToHead, game)
+			}
+		}
+		title := fmt.Sprintf("%s vs %s", name, getDisplayName(event.RoomID, opponent))
+		if len(headToHead) == 0 {
+			message.line(fmt.Sprintf("%s: no finished games.", title))
+		} else {
+			versus := computeStats(userID, headToHead)
+			message.heading(title)
+			message.recordTable(versus.White, versus.Black)
+		}
+	}
+
+	message.send(event.RoomID)
+}
+
+// nonEmpty returns the arguments without the empty strings left by repeated
+// spaces.
+func nonEmpty(args []string) []string {
+	result := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg != "" {
+			result = append(result, arg)
+		}
+	}
+	return result
+}
@@ -0,0 +1,117 @@
+//
+// Caches uploaded board images so that identical renders can reuse the media.
+//
+
+package store
+
+import (
+	"database/sql"
+
+	mid "maunium.net/go/mautrix/id"
+)
+
+type BoardImageCache struct {
+	DB *sql.DB
+}
+
+// UploadedBoardImage is the media and metadata of a board image that has
+// already been uploaded to the media repository.
+type UploadedBoardImage struct {
+	ContentURI mid.ContentURIString
+	MimeType   string
+	Width      int
+	Height     int
+	Size       int
+
+	ThumbnailURI    mid.ContentURIString
+	ThumbnailWidth  int
+	ThumbnailHeight int
+	ThumbnailSize   int
+
+	Blurhash string
+}
+
+func (bc *BoardImageCache) CreateTables() error {
+	tx, err := bc.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	queries := []string{
+		`
+		CREATE TABLE IF NOT EXISTS board_image_cache (
+			render_key        TEXT PRIMARY KEY,
+			content_uri       TEXT,
+			width             INTEGER,
+			height            INTEGER,
+			size              INTEGER,
+			thumbnail_uri     TEXT,
+			thumbnail_width   INTEGER,
+			thumbnail_height  INTEGER,
+			thumbnail_size    INTEGER,
+			blurhash          TEXT
+		)
+		`,
+	}
+
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetImage returns the uploaded image for the given render key, or nil if the
+// render has not been uploaded before.
+func (bc *BoardImageCache) GetImage(renderKey string) *UploadedBoardImage {
+	row := bc.DB.QueryRow(`
+		SELECT content_uri, width, height, size,
+			thumbnail_uri, thumbnail_width, thumbnail_height, thumbnail_size,
+			blurhash
+		FROM board_image_cache
+		WHERE render_key = ?
+	`, renderKey)
+
+	// Board images are always rendered as PNGs.
+	image := UploadedBoardImage{MimeType: "image/png"}
+	err := row.Scan(
+		&image.ContentURI, &image.Width, &image.Height, &image.Size,
+		&image.ThumbnailURI, &image.ThumbnailWidth, &image.ThumbnailHeight, &image.ThumbnailSize,
+		&image.Blurhash,
+	)
+	if err != nil {
+		return nil
+	}
+	return &image
+}
+
+func (bc *BoardImageCache) SetImage(renderKey string, image *UploadedBoardImage) error {
+	_, err := bc.DB.Exec(`
+		INSERT INTO board_image_cache (
+			render_key, content_uri, width, height, size,
+			thumbnail_uri, thumbnail_width, thumbnail_height, thumbnail_size,
+			blurhash
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (render_key) DO UPDATE SET
+			content_uri=EXCLUDED.content_uri,
+			width=EXCLUDED.width,
+			height=EXCLUDED.height,
+			size=EXCLUDED.size,
+			thumbnail_uri=EXCLUDED.thumbnail_uri,
+			thumbnail_width=EXCLUDED.thumbnail_width,
+			thumbnail_height=EXCLUDED.thumbnail_height,
+			thumbnail_size=EXCLUDED.thumbnail_size,
+			blurhash=EXCLUDED.blurhash
+	`, renderKey, image.ContentURI, image.Width, image.Height, image.Size,
+		image.ThumbnailURI, image.ThumbnailWidth, image.ThumbnailHeight, image.ThumbnailSize,
+		image.Blurhash)
+	return err
+}
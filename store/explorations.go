@@ -0,0 +1,86 @@
+//
+// Stores the analysis threads opened with the explore command: the variation
+// tree of each one and the position in the tree that it is showing.
+//
+
+package store
+
+import (
+	"database/sql"
+
+	mid "maunium.net/go/mautrix/id"
+)
+
+type ExplorationStore struct {
+	DB *sql.DB
+}
+
+// Exploration is an analysis thread. EventID is the board image that starts
+// the thread, Tree is the variation tree encoded as JSON, and Path is the
+// path through the tree to the position being shown.
+type Exploration struct {
+	RoomID  mid.RoomID
+	EventID mid.EventID
+	Tree    string
+	Path    string
+}
+
+func (es *ExplorationStore) CreateTables() error {
+	tx, err := es.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	queries := []string{
+		`
+		CREATE TABLE IF NOT EXISTS explorations (
+			room_id   TEXT,
+			event_id  TEXT,
+			tree      TEXT,
+			path      TEXT,
+			PRIMARY KEY (room_id, event_id)
+		)
+		`,
+	}
+
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetExploration returns the analysis thread started by the event, or nil if
+// the event doesn't start one.
+func (es *ExplorationStore) GetExploration(roomID mid.RoomID, eventID mid.EventID) *Exploration {
+	row := es.DB.QueryRow(`
+		SELECT tree, path
+		FROM explorations
+		WHERE room_id = ?
+			AND event_id = ?
+	`, roomID, eventID)
+
+	exploration := Exploration{RoomID: roomID, EventID: eventID}
+	if err := row.Scan(&exploration.Tree, &exploration.Path); err != nil {
+		return nil
+	}
+	return &exploration
+}
+
+func (es *ExplorationStore) SetExploration(exploration *Exploration) error {
+	_, err := es.DB.Exec(`
+		INSERT INTO explorations (room_id, event_id, tree, path)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (room_id, event_id) DO UPDATE SET
+			tree=EXCLUDED.tree,
+			path=EXCLUDED.path
+	`, exploration.RoomID, exploration.EventID, exploration.Tree, exploration.Path)
+	return err
+}
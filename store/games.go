@@ -0,0 +1,191 @@
+//
+// Archives every game that the bot has hosted.
+//
+
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	mid "maunium.net/go/mautrix/id"
+)
+
+type GameStore struct {
+	DB *sql.DB
+}
+
+// ArchivedGame is a game as it is stored in the archive. Result is the PGN
+// result of the game, which is "*" while the game is in progress.
+type ArchivedGame struct {
+	ID          string
+	RoomID      mid.RoomID
+	White       mid.UserID
+	Black       mid.UserID
+	TimeControl string
+	Rated       bool
+	PGN         string
+	Result      string
+	StartedAt   time.Time
+	// EndedAt is the zero time while the game is in progress.
+	EndedAt time.Time
+}
+
+func (gs *GameStore) CreateTables() error {
+	tx, err := gs.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	queries := []string{
+		`
+		CREATE TABLE IF NOT EXISTS games (
+			game_id       TEXT PRIMARY KEY,
+			room_id       TEXT NOT NULL,
+			white         TEXT,
+			black         TEXT,
+			time_control  TEXT,
+			rated         BOOLEAN,
+			pgn           TEXT,
+			result        TEXT,
+			started_at    INTEGER,
+			ended_at      INTEGER NULL
+		)
+		`,
+		`CREATE INDEX IF NOT EXISTS games_room_id_idx ON games (room_id)`,
+		`CREATE INDEX IF NOT EXISTS games_white_idx ON games (white)`,
+		`CREATE INDEX IF NOT EXISTS games_black_idx ON games (black)`,
+	}
+
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	// Games weren't rated when the table was first created, so older
+	// databases don't have the rated column yet.
+	rated, err := hasColumn(tx, "games", "rated")
+	if err == nil && !rated {
+		_, err = tx.Exec(`ALTER TABLE games ADD COLUMN rated BOOLEAN`)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// hasColumn returns whether the table has the column.
+func hasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query(`SELECT name FROM pragma_table_info($1)`, table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+func toMillis(t time.Time) sql.NullInt64 {
+	if t.IsZero() {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.UnixNano() / int64(time.Millisecond), Valid: true}
+}
+
+func fromMillis(ms sql.NullInt64) time.Time {
+	if !ms.Valid {
+		return time.Time{}
+	}
+	return time.Unix(0, ms.Int64*int64(time.Millisecond))
+}
+
+// SaveGame inserts the game into the archive, or updates it if it is already
+// there. The start time is only set when the game is first inserted.
+func (gs *GameStore) SaveGame(game *ArchivedGame) error {
+	_, err := gs.DB.Exec(`
+		INSERT INTO games (
+			game_id, room_id, white, black, time_control, rated, pgn, result,
+			started_at, ended_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (game_id) DO UPDATE SET
+			white=EXCLUDED.white,
+			black=EXCLUDED.black,
+			time_control=EXCLUDED.time_control,
+			rated=EXCLUDED.rated,
+			pgn=EXCLUDED.pgn,
+			result=EXCLUDED.result,
+			ended_at=EXCLUDED.ended_at
+	`, game.ID, game.RoomID, game.White, game.Black, game.TimeControl, game.Rated, game.PGN, game.Result,
+		toMillis(game.StartedAt), toMillis(game.EndedAt))
+	return err
+}
+
+const selectGames = `
+	SELECT game_id, room_id, white, black, time_control, rated, pgn, result,
+		started_at, ended_at
+	FROM games
+`
+
+func (gs *GameStore) scanGames(rows *sql.Rows, err error) []*ArchivedGame {
+	games := make([]*ArchivedGame, 0)
+	if err != nil {
+		log.Errorf("Failed to query games: %v", err)
+		return games
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var game ArchivedGame
+		var startedAt, endedAt sql.NullInt64
+		err := rows.Scan(&game.ID, &game.RoomID, &game.White, &game.Black, &game.TimeControl,
+			&game.Rated, &game.PGN, &game.Result, &startedAt, &endedAt)
+		if err != nil {
+			log.Errorf("Failed to scan game: %v", err)
+			continue
+		}
+		game.StartedAt = fromMillis(startedAt)
+		game.EndedAt = fromMillis(endedAt)
+		games = append(games, &game)
+	}
+	return games
+}
+
+// GetGame returns the game with the given ID, or nil if there is no such
+// game.
+func (gs *GameStore) GetGame(gameID string) *ArchivedGame {
+	games := gs.scanGames(gs.DB.Query(selectGames+"WHERE game_id = ?", gameID))
+	if len(games) == 0 {
+		return nil
+	}
+	return games[0]
+}
+
+// GetGamesInRoom returns the games played in the room, oldest first.
+func (gs *GameStore) GetGamesInRoom(roomID mid.RoomID) []*ArchivedGame {
+	return gs.scanGames(gs.DB.Query(selectGames+"WHERE room_id = ? ORDER BY started_at", roomID))
+}
+
+// GetGamesForPlayer returns the games that the user played either side of,
+// oldest first.
+func (gs *GameStore) GetGamesForPlayer(userID mid.UserID) []*ArchivedGame {
+	return gs.scanGames(gs.DB.Query(selectGames+"WHERE white = ? OR black = ? ORDER BY started_at", userID, userID))
+}
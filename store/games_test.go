@@ -0,0 +1,59 @@
+package store
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestGameStoreAddsRatedColumn(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "chessbot.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The games table as it was before games were rated.
+	_, err = db.Exec(`
+		CREATE TABLE games (
+			game_id       TEXT PRIMARY KEY,
+			room_id       TEXT NOT NULL,
+			white         TEXT,
+			black         TEXT,
+			time_control  TEXT,
+			pgn           TEXT,
+			result        TEXT,
+			started_at    INTEGER,
+			ended_at      INTEGER NULL
+		)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gs := GameStore{DB: db}
+	for i := 0; i < 2; i++ {
+		if err := gs.CreateTables(); err != nil {
+			t.Fatalf("CreateTables run %d: %v", i+1, err)
+		}
+	}
+
+	game := ArchivedGame{
+		ID:          "abcdefgh",
+		RoomID:      "!room:test",
+		TimeControl: "-",
+		Rated:       true,
+		PGN:         "*",
+		Result:      "*",
+		StartedAt:   time.Now(),
+	}
+	if err := gs.SaveGame(&game); err != nil {
+		t.Fatal(err)
+	}
+	if saved := gs.GetGame(game.ID); saved == nil || !saved.Rated {
+		t.Errorf("saved game %+v, want a rated game", saved)
+	}
+}
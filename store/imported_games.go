@@ -0,0 +1,80 @@
+//
+// Stores games imported from PGN files until they are continued or replayed.
+//
+
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	mid "maunium.net/go/mautrix/id"
+)
+
+type ImportedGameStore struct {
+	DB *sql.DB
+}
+
+type ImportedGame struct {
+	ID         string
+	RoomID     mid.RoomID
+	PGN        string
+	ImportedAt time.Time
+}
+
+func (is *ImportedGameStore) CreateTables() error {
+	tx, err := is.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	queries := []string{
+		`
+		CREATE TABLE IF NOT EXISTS imported_games (
+			import_id    TEXT PRIMARY KEY,
+			room_id      TEXT NOT NULL,
+			pgn          TEXT,
+			imported_at  INTEGER
+		)
+		`,
+	}
+
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (is *ImportedGameStore) SaveImportedGame(game *ImportedGame) error {
+	_, err := is.DB.Exec(`
+		INSERT INTO imported_games (import_id, room_id, pgn, imported_at)
+		VALUES ($1, $2, $3, $4)
+	`, game.ID, game.RoomID, game.PGN, toMillis(game.ImportedAt))
+	return err
+}
+
+// GetImportedGame returns the imported game with the given ID, or nil if
+// there is no such game.
+func (is *ImportedGameStore) GetImportedGame(importID string) *ImportedGame {
+	row := is.DB.QueryRow(`
+		SELECT room_id, pgn, imported_at
+		FROM imported_games
+		WHERE import_id = ?
+	`, importID)
+
+	game := ImportedGame{ID: importID}
+	var importedAt sql.NullInt64
+	if err := row.Scan(&game.RoomID, &game.PGN, &importedAt); err != nil {
+		return nil
+	}
+	game.ImportedAt = fromMillis(importedAt)
+	return &game
+}
@@ -0,0 +1,85 @@
+//
+// Stores which ply of which game each move message played, so that players
+// can edit their last move.
+//
+
+package store
+
+import (
+	"database/sql"
+
+	mid "maunium.net/go/mautrix/id"
+)
+
+type MoveEventStore struct {
+	DB *sql.DB
+}
+
+// MoveEvent is a message that played a move. Ply is the number of plies in
+// the game after the move.
+type MoveEvent struct {
+	RoomID  mid.RoomID
+	EventID mid.EventID
+	GameID  string
+	Ply     int
+}
+
+func (ms *MoveEventStore) CreateTables() error {
+	tx, err := ms.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	queries := []string{
+		`
+		CREATE TABLE IF NOT EXISTS move_events (
+			room_id   TEXT,
+			event_id  TEXT,
+			game_id   TEXT,
+			ply       INTEGER,
+			PRIMARY KEY (room_id, event_id)
+		)
+		`,
+	}
+
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetMoveEvent returns the move played by the event, or nil if the event
+// didn't play a move.
+func (ms *MoveEventStore) GetMoveEvent(roomID mid.RoomID, eventID mid.EventID) *MoveEvent {
+	row := ms.DB.QueryRow(`
+		SELECT game_id, ply
+		FROM move_events
+		WHERE room_id = ?
+			AND event_id = ?
+	`, roomID, eventID)
+
+	moveEvent := MoveEvent{RoomID: roomID, EventID: eventID}
+	if err := row.Scan(&moveEvent.GameID, &moveEvent.Ply); err != nil {
+		return nil
+	}
+	return &moveEvent
+}
+
+func (ms *MoveEventStore) SetMoveEvent(moveEvent *MoveEvent) error {
+	_, err := ms.DB.Exec(`
+		INSERT INTO move_events (room_id, event_id, game_id, ply)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (room_id, event_id) DO UPDATE SET
+			game_id=EXCLUDED.game_id,
+			ply=EXCLUDED.ply
+	`, moveEvent.RoomID, moveEvent.EventID, moveEvent.GameID, moveEvent.Ply)
+	return err
+}
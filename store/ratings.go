@@ -0,0 +1,153 @@
+//
+// Stores the Glicko-2 ratings of players in each rating pool.
+//
+
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	mid "maunium.net/go/mautrix/id"
+)
+
+type RatingStore struct {
+	DB *sql.DB
+}
+
+// Rating is a Glicko-2 rating, on the Glicko scale.
+type Rating struct {
+	UserID     mid.UserID
+	Pool       string
+	Rating     float64
+	Deviation  float64
+	Volatility float64
+	Games      int
+	Wins       int
+	Draws      int
+	Losses     int
+	UpdatedAt  time.Time
+}
+
+// Defaults for players who haven't played a rated game in a pool yet.
+const (
+	DefaultRating     = 1500
+	DefaultDeviation  = 350
+	DefaultVolatility = 0.06
+)
+
+func (rs *RatingStore) CreateTables() error {
+	tx, err := rs.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	queries := []string{
+		`
+		CREATE TABLE IF NOT EXISTS ratings (
+			user_id     TEXT,
+			pool        TEXT,
+			rating      REAL,
+			deviation   REAL,
+			volatility  REAL,
+			games       INTEGER,
+			wins        INTEGER,
+			draws       INTEGER,
+			losses      INTEGER,
+			updated_at  INTEGER,
+			PRIMARY KEY (user_id, pool)
+		)
+		`,
+	}
+
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetRating returns the user's rating in the pool, or the default rating if
+// the user hasn't played a rated game in the pool.
+func (rs *RatingStore) GetRating(userID mid.UserID, pool string) *Rating {
+	row := rs.DB.QueryRow(`
+		SELECT rating, deviation, volatility, games, wins, draws, losses, updated_at
+		FROM ratings
+		WHERE user_id = ?
+			AND pool = ?
+	`, userID, pool)
+
+	rating := Rating{UserID: userID, Pool: pool}
+	var updatedAt sql.NullInt64
+	err := row.Scan(&rating.Rating, &rating.Deviation, &rating.Volatility,
+		&rating.Games, &rating.Wins, &rating.Draws, &rating.Losses, &updatedAt)
+	if err != nil {
+		rating.Rating = DefaultRating
+		rating.Deviation = DefaultDeviation
+		rating.Volatility = DefaultVolatility
+		return &rating
+	}
+	rating.UpdatedAt = fromMillis(updatedAt)
+	return &rating
+}
+
+func (rs *RatingStore) SetRating(rating *Rating) error {
+	_, err := rs.DB.Exec(`
+		INSERT INTO ratings (
+			user_id, pool, rating, deviation, volatility,
+			games, wins, draws, losses, updated_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (user_id, pool) DO UPDATE SET
+			rating=EXCLUDED.rating,
+			deviation=EXCLUDED.deviation,
+			volatility=EXCLUDED.volatility,
+			games=EXCLUDED.games,
+			wins=EXCLUDED.wins,
+			draws=EXCLUDED.draws,
+			losses=EXCLUDED.losses,
+			updated_at=EXCLUDED.updated_at
+	`, rating.UserID, rating.Pool, rating.Rating, rating.Deviation, rating.Volatility,
+		rating.Games, rating.Wins, rating.Draws, rating.Losses, toMillis(rating.UpdatedAt))
+	return err
+}
+
+// GetRatingsInPool returns the ratings in the pool whose deviation is at most
+// maxDeviation, highest rated first.
+func (rs *RatingStore) GetRatingsInPool(pool string, maxDeviation float64) []*Rating {
+	ratings := make([]*Rating, 0)
+	rows, err := rs.DB.Query(`
+		SELECT user_id, rating, deviation, volatility, games, wins, draws, losses, updated_at
+		FROM ratings
+		WHERE pool = ?
+			AND deviation <= ?
+		ORDER BY rating DESC
+	`, pool, maxDeviation)
+	if err != nil {
+		log.Errorf("Failed to query %s ratings: %v", pool, err)
+		return ratings
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rating := Rating{Pool: pool}
+		var updatedAt sql.NullInt64
+		err := rows.Scan(&rating.UserID, &rating.Rating, &rating.Deviation, &rating.Volatility,
+			&rating.Games, &rating.Wins, &rating.Draws, &rating.Losses, &updatedAt)
+		if err != nil {
+			log.Errorf("Failed to scan rating: %v", err)
+			continue
+		}
+		rating.UpdatedAt = fromMillis(updatedAt)
+		ratings = append(ratings, &rating)
+	}
+	return ratings
+}
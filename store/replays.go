@@ -0,0 +1,85 @@
+//
+// Stores the games being replayed and the ply that each replay is showing.
+//
+
+package store
+
+import (
+	"database/sql"
+
+	mid "maunium.net/go/mautrix/id"
+)
+
+type ReplayStore struct {
+	DB *sql.DB
+}
+
+// Replay is a game being replayed by editing a board image in place.
+// EventID is the board image event, and Ply is the number of moves of the
+// game that it shows.
+type Replay struct {
+	RoomID  mid.RoomID
+	EventID mid.EventID
+	PGN     string
+	Ply     int
+}
+
+func (rs *ReplayStore) CreateTables() error {
+	tx, err := rs.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	queries := []string{
+		`
+		CREATE TABLE IF NOT EXISTS replays (
+			room_id   TEXT,
+			event_id  TEXT,
+			pgn       TEXT,
+			ply       INTEGER,
+			PRIMARY KEY (room_id, event_id)
+		)
+		`,
+	}
+
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetReplay returns the replay shown by the event, or nil if the event isn't
+// a replay.
+func (rs *ReplayStore) GetReplay(roomID mid.RoomID, eventID mid.EventID) *Replay {
+	row := rs.DB.QueryRow(`
+		SELECT pgn, ply
+		FROM replays
+		WHERE room_id = ?
+			AND event_id = ?
+	`, roomID, eventID)
+
+	replay := Replay{RoomID: roomID, EventID: eventID}
+	if err := row.Scan(&replay.PGN, &replay.Ply); err != nil {
+		return nil
+	}
+	return &replay
+}
+
+func (rs *ReplayStore) SetReplay(replay *Replay) error {
+	_, err := rs.DB.Exec(`
+		INSERT INTO replays (room_id, event_id, pgn, ply)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (room_id, event_id) DO UPDATE SET
+			pgn=EXCLUDED.pgn,
+			ply=EXCLUDED.ply
+	`, replay.RoomID, replay.EventID, replay.PGN, replay.Ply)
+	return err
+}
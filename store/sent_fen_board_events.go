@@ -1,5 +1,6 @@
 //
-// Stores the event IDs of the board images sent in reply to FENs.
+// Stores the event IDs of the board images sent in reply to FENs. A message
+// with several FENs gets a single grid image, which is tracked the same way.
 //
 
 package store
@@ -0,0 +1,86 @@
+//
+// Stores the votes cast in vote chess games: the move that each member of the
+// room voted for in each poll.
+//
+
+package store
+
+import (
+	"database/sql"
+
+	log "github.com/sirupsen/logrus"
+	mid "maunium.net/go/mautrix/id"
+)
+
+type VoteStore struct {
+	DB *sql.DB
+}
+
+func (vs *VoteStore) CreateTables() error {
+	tx, err := vs.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	queries := []string{
+		`
+		CREATE TABLE IF NOT EXISTS votes (
+			room_id        TEXT,
+			poll_event_id  TEXT,
+			user_id        TEXT,
+			move           TEXT,
+			PRIMARY KEY (room_id, poll_event_id, user_id)
+		)
+		`,
+	}
+
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SetVote records the member's vote in the poll, replacing any vote they
+// cast before.
+func (vs *VoteStore) SetVote(roomID mid.RoomID, pollEventID mid.EventID, userID mid.UserID, move string) error {
+	_, err := vs.DB.Exec(`
+		INSERT INTO votes (room_id, poll_event_id, user_id, move)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (room_id, poll_event_id, user_id) DO UPDATE SET
+			move=EXCLUDED.move
+	`, roomID, pollEventID, userID, move)
+	return err
+}
+
+// GetVotes returns the move that each member voted for in the poll.
+func (vs *VoteStore) GetVotes(roomID mid.RoomID, pollEventID mid.EventID) map[mid.UserID]string {
+	votes := map[mid.UserID]string{}
+	rows, err := vs.DB.Query(`
+		SELECT user_id, move
+		FROM votes
+		WHERE room_id = ?
+			AND poll_event_id = ?
+	`, roomID, pollEventID)
+	if err != nil {
+		log.Errorf("Failed to get the votes in poll %s: %v", pollEventID, err)
+		return votes
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID mid.UserID
+		var move string
+		if err := rows.Scan(&userID, &move); err == nil {
+			votes[userID] = move
+		}
+	}
+	return votes
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/notnil/chess"
+)
+
+// VariantThreeCheck is the value of the PGN Variant tag for Three-check games.
+const VariantThreeCheck = "Three-check"
+
+// threeCheckStartingFEN is the standard starting position with three checks
+// left for each side, in the FEN field that lichess uses.
+const threeCheckStartingFEN = "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 3+3 0 1"
+
+var checksFieldRegex = regexp.MustCompile(`^(\d)\+(\d)$`)
+
+// threeCheckVariant is Three-check, where giving a third check wins. Its
+// starting position has the checks field, which is what makes VariantGame
+// count the checks.
+type threeCheckVariant struct{}
+
+func (threeCheckVariant) Name() string {
+	return VariantThreeCheck
+}
+
+func (threeCheckVariant) StartingFEN() string {
+	return threeCheckStartingFEN
+}
+
+func (threeCheckVariant) Outcome(position *variantPosition) (chess.Outcome, string) {
+	if position.checksLeft == nil {
+		return chess.NoOutcome, ""
+	}
+	if position.checksLeft[chess.White] <= 0 {
+		return chess.WhiteWon, "White gave a third check."
+	}
+	if position.checksLeft[chess.Black] <= 0 {
+		return chess.BlackWon, "Black gave a third check."
+	}
+	return chess.NoOutcome, ""
+}
+
+// InsufficientMaterialDraws is false because even a lone knight can keep
+// giving checks.
+func (threeCheckVariant) InsufficientMaterialDraws() bool {
+	return false
+}
+
+func (threeCheckVariant) Evaluated() bool {
+	return false
+}
+
+// parseChecksField parses the number of checks that White and Black still
+// have to give, written like 3+3.
+func parseChecksField(field string) (map[chess.Color]int, bool) {
+	match := checksFieldRegex.FindStringSubmatch(field)
+	if match == nil {
+		return nil, false
+	}
+	white, _ := strconv.Atoi(match[1])
+	black, _ := strconv.Atoi(match[2])
+	return map[chess.Color]int{chess.White: white, chess.Black: black}, true
+}
+
+// checksField writes the number of checks that each side still has to give.
+func checksField(checksLeft map[chess.Color]int) string {
+	return fmt.Sprintf("%d+%d", checksLeft[chess.White], checksLeft[chess.Black])
+}
+
+// Checks returns the number of checks that each side has given after the
+// number of plies, or false if the variant doesn't count them.
+func (g *VariantGame) Checks(ply int) (white, black int, ok bool) {
+	start, position := g.positions[0].checksLeft, g.positions[ply].checksLeft
+	if position == nil {
+		return 0, 0, false
+	}
+	return start[chess.White] - position[chess.White], start[chess.Black] - position[chess.Black], true
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/notnil/chess"
+)
+
+// VariantStandard is the value of the PGN Variant tag for standard chess,
+// which is played with notnil/chess rather than a VariantGame.
+const VariantStandard = "Standard"
+
+// Variant is the rules of a variant played as a VariantGame. VariantGame
+// already knows Chess960 castling and drops, so a variant only has to say
+// where games start and how they can end.
+type Variant interface {
+	// Name is the value of the PGN Variant tag.
+	Name() string
+
+	// StartingFEN is the position that games start from, unless the PGN
+	// gives another one.
+	StartingFEN() string
+
+	// Outcome returns the outcome if the variant's own rules end the game in
+	// the position, along with a sentence saying how it ended. It returns
+	// chess.NoOutcome if the game goes on, or if only the usual rules of
+	// checkmate and draws apply.
+	Outcome(position *variantPosition) (chess.Outcome, string)
+
+	// InsufficientMaterialDraws is whether a position where neither side
+	// can checkmate is drawn. It isn't in variants where the game can be
+	// won without checkmating or where captured pieces come back.
+	InsufficientMaterialDraws() bool
+
+	// Evaluated is whether the engine understands the variant well enough
+	// for its evaluations to be shown.
+	Evaluated() bool
+}
+
+// variants are the variants that games can be started in, by the names that
+// the new command accepts for them. Chess960 and Bughouse are there too,
+// although the new command handles them itself because they take more
+// options.
+var variants = map[string]Variant{
+	"960":           chess960Variant{},
+	"chess960":      chess960Variant{},
+	"crazyhouse":    crazyhouseVariant{},
+	"zh":            crazyhouseVariant{},
+	"threecheck":    threeCheckVariant{},
+	"three-check":   threeCheckVariant{},
+	"3check":        threeCheckVariant{},
+	"kingofthehill": kingOfTheHillVariant{},
+	"koth":          kingOfTheHillVariant{},
+	"bughouse":      bughouseVariant{},
+}
+
+// lookupVariant returns the variant with the name in the PGN Variant tag.
+// Variants that the bot doesn't know are played with the rules of Chess960,
+// which include those of standard chess, so that their PGNs can still be
+// read.
+func lookupVariant(name string) Variant {
+	for _, variant := range variants {
+		if strings.EqualFold(variant.Name(), name) {
+			return variant
+		}
+	}
+	return otherVariant{name: name}
+}
+
+// otherVariant is a variant that the bot doesn't know the rules of.
+type otherVariant struct {
+	name string
+}
+
+func (v otherVariant) Name() string {
+	return v.name
+}
+
+func (otherVariant) StartingFEN() string {
+	return chess.StartingPosition().String()
+}
+
+func (otherVariant) Outcome(*variantPosition) (chess.Outcome, string) {
+	return chess.NoOutcome, ""
+}
+
+func (otherVariant) InsufficientMaterialDraws() bool {
+	return true
+}
+
+func (otherVariant) Evaluated() bool {
+	return false
+}
+
+// parseGame parses the PGN of the game in the state with the rules of its
+// variant. Games from before the variant was stored in the state are parsed
+// by their PGN Variant tag.
+func (c *StateChessGameEventContent) parseGame() (Game, error) {
+	switch c.Variant {
+	case "":
+		return parseGamePGN(c.PGN)
+	case VariantStandard:
+		return parseStandardPGN(c.PGN)
+	default:
+		return parseVariantPGN(lookupVariant(c.Variant), c.PGN)
+	}
+}
+
+// gameVariant returns the name of the variant of the game.
+func gameVariant(game Game) string {
+	if variant, ok := game.(*VariantGame); ok {
+		return variant.Variant().Name()
+	}
+	return VariantStandard
+}
+
+// gameStatus says how the game ended, or whose move it is.
+func gameStatus(game Game) string {
+	switch drawMethod(game) {
+	case chess.DrawOffer:
+		return "Draw agreed."
+	case chess.ThreefoldRepetition:
+		return "Draw claimed by threefold repetition."
+	case chess.FiftyMoveRule:
+		return "Draw claimed under the fifty-move rule."
+	}
+	variant, ok := game.(*VariantGame)
+	if !ok {
+		return positionStatus(game.Position())
+	}
+	switch {
+	case variant.termination != "":
+		return variant.termination
+	case variant.method == chess.Checkmate:
+		return fmt.Sprintf("%s is checkmated.", colorName(variant.Position().Turn()))
+	case variant.method == chess.Stalemate:
+		return "Stalemate."
+	}
+	return fmt.Sprintf("%s to move.", colorName(variant.Position().Turn()))
+}
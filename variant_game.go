@@ -0,0 +1,847 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/notnil/chess"
+)
+
+// variantPosition is a position of a VariantGame. notnil/chess only knows
+// the standard castling rules, so the notnil position never has castling
+// rights, and the castling rights are kept here instead.
+type variantPosition struct {
+	position *chess.Position
+
+	// castling holds the files of the rooks that can still castle, as in
+	// Shredder-FEN: upper case for White and lower case for Black.
+	castling string
+
+	// pockets counts the pieces in hand that can be dropped. It is nil in
+	// variants without drops.
+	pockets map[chess.Piece]int
+	// promoted holds the squares of the pieces that were promoted from
+	// pawns, which go back to being pawns when they are captured.
+	promoted map[chess.Square]bool
+
+	// checksLeft counts the checks that each side still has to give to win.
+	// It is nil in variants that don't count checks.
+	checksLeft map[chess.Color]int
+}
+
+// castleMove is a castling move, which takes the king and the rook to the
+// same squares as in standard chess, wherever they start.
+type castleMove struct {
+	side           chess.Side
+	king, rook     chess.Square
+	kingTo, rookTo chess.Square
+}
+
+// dropMove puts a piece from the pocket of the side to move on an empty
+// square.
+type dropMove struct {
+	piece  chess.Piece
+	square chess.Square
+}
+
+// variantMove is either an ordinary move, which notnil/chess generates, a
+// castling move or a drop.
+type variantMove struct {
+	move   *chess.Move
+	castle *castleMove
+	drop   *dropMove
+}
+
+// VariantGame is a game of a variant that notnil/chess doesn't know the rules
+// of. notnil/chess still generates the ordinary moves, and the castling
+// moves are generated here following the Chess960 rules, which include the
+// standard ones. The Variant adds its own ways of ending the game.
+type VariantGame struct {
+	variant   Variant
+	tagPairs  []*chess.TagPair
+	positions []*variantPosition
+	moves     []*chess.Move
+	sans      []string
+	nags      [][]int
+	comments  [][]string
+	outcome   chess.Outcome
+	method    chess.Method
+
+	// termination says how the game ended if the variant's own rules ended
+	// it, in which case the method is chess.NoMethod.
+	termination string
+}
+
+var castlingInputRegex = regexp.MustCompile(`^[O0o]-[O0o](-[O0o])?[+#]?[!?]*$`)
+
+// NewVariantGame starts a game of the variant from the position, which can
+// use either X-FEN or Shredder-FEN castling rights. The SetUp and FEN tags
+// record the starting position.
+func NewVariantGame(variant Variant, fen string) (*VariantGame, error) {
+	start, err := parseVariantFEN(fen)
+	if err != nil {
+		return nil, err
+	}
+	game := &VariantGame{
+		variant:   variant,
+		positions: []*variantPosition{start},
+		outcome:   chess.NoOutcome,
+		method:    chess.NoMethod,
+	}
+	game.AddTagPair("Variant", variant.Name())
+	game.AddTagPair("SetUp", "1")
+	game.AddTagPair("FEN", start.fen())
+	return game, nil
+}
+
+// parseVariantFEN parses a FEN with X-FEN or Shredder-FEN castling rights.
+// The move counters are optional. The board can be followed by the pockets,
+// either in brackets or as a ninth rank, and promoted pieces can be marked
+// with a tilde, as in Crazyhouse FENs. The checks that each side has left to
+// give in Three-check can come before the move counters.
+func parseVariantFEN(fen string) (*variantPosition, error) {
+	fields := strings.Fields(fen)
+	var checksLeft map[chess.Color]int
+	if len(fields) >= 5 {
+		if checks, ok := parseChecksField(fields[4]); ok {
+			checksLeft = checks
+			fields = append(fields[:4], fields[5:]...)
+		}
+	}
+	if len(fields) == 4 {
+		fields = append(fields, "0", "1")
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("a FEN has six fields, but this has %d", len(fields))
+	}
+	board, pockets, err := parsePockets(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	board, promoted := parsePromoted(board)
+	fields[0] = board
+	castlingField := fields[2]
+	fields[2] = "-"
+	var position chess.Position
+	if err := position.UnmarshalText([]byte(strings.Join(fields, " "))); err != nil {
+		return nil, err
+	}
+
+	p := &variantPosition{position: &position, pockets: pockets, promoted: promoted, checksLeft: checksLeft}
+	if castlingField == "-" {
+		return p, nil
+	}
+	for _, r := range castlingField {
+		color := chess.White
+		if r >= 'a' && r <= 'z' {
+			color = chess.Black
+		}
+		rank := backRank(color)
+		king, ok := p.backRankKing(color)
+		if !ok {
+			return nil, fmt.Errorf("the castling rights %s need the king on the back rank", castlingField)
+		}
+		rook := chess.NewPiece(chess.Rook, color)
+		file := chess.File(-1)
+		switch upper := strings.ToUpper(string(r)); upper {
+		case "K":
+			for f := chess.FileH; f > king.File(); f-- {
+				if position.Board().Piece(chess.NewSquare(f, rank)) == rook {
+					file = f
+					break
+				}
+			}
+		case "Q":
+			for f := chess.FileA; f < king.File(); f++ {
+				if position.Board().Piece(chess.NewSquare(f, rank)) == rook {
+					file = f
+					break
+				}
+			}
+		default:
+			if upper >= "A" && upper <= "H" && position.Board().Piece(chess.NewSquare(chess.File(upper[0]-'A'), rank)) == rook {
+				file = chess.File(upper[0] - 'A')
+			}
+		}
+		if file < 0 {
+			return nil, fmt.Errorf("the castling rights %s don't match the rooks", castlingField)
+		}
+		letter := file.String()
+		if color == chess.White {
+			letter = strings.ToUpper(letter)
+		}
+		if !strings.Contains(p.castling, letter) {
+			p.castling += letter
+		}
+	}
+	return p, nil
+}
+
+// backRankKing returns the square of the king of the colour, if it is on its
+// back rank.
+func (p *variantPosition) backRankKing(color chess.Color) (chess.Square, bool) {
+	rank := backRank(color)
+	king := chess.NewPiece(chess.King, color)
+	for f := chess.FileA; f <= chess.FileH; f++ {
+		if sq := chess.NewSquare(f, rank); p.position.Board().Piece(sq) == king {
+			return sq, true
+		}
+	}
+	return chess.NoSquare, false
+}
+
+// castlingRooks returns the squares of the rooks of the colour that can still
+// castle.
+func (p *variantPosition) castlingRooks(color chess.Color) []chess.Square {
+	rooks := make([]chess.Square, 0, 2)
+	for _, r := range p.castling {
+		if rook, rookColor := castlingRook(r); rookColor == color {
+			rooks = append(rooks, rook)
+		}
+	}
+	return rooks
+}
+
+// castlingRook returns the square and colour of the rook that a Shredder-FEN
+// castling right refers to.
+func castlingRook(r rune) (chess.Square, chess.Color) {
+	if r >= 'a' {
+		return chess.NewSquare(chess.File(r-'a'), chess.Rank8), chess.Black
+	}
+	return chess.NewSquare(chess.File(r-'A'), chess.Rank1), chess.White
+}
+
+// xfenCastling returns the castling rights in X-FEN, which uses KQkq unless
+// there is another rook between the castling rook and the corner.
+func (p *variantPosition) xfenCastling() string {
+	var castling strings.Builder
+	for _, color := range []chess.Color{chess.White, chess.Black} {
+		king, ok := p.backRankKing(color)
+		if !ok {
+			continue
+		}
+		rooks := p.castlingRooks(color)
+		sort.Slice(rooks, func(i, j int) bool { return rooks[i] > rooks[j] })
+		for _, rook := range rooks {
+			letter := rook.File().String()
+			outermost := true
+			step := 1
+			if rook.File() < king.File() {
+				step = -1
+			}
+			for f := int(rook.File()) + step; f >= 0 && f <= 7; f += step {
+				if p.position.Board().Piece(chess.NewSquare(chess.File(f), rook.Rank())) == chess.NewPiece(chess.Rook, color) {
+					outermost = false
+				}
+			}
+			if outermost && step == 1 {
+				letter = "k"
+			} else if outermost {
+				letter = "q"
+			}
+			if color == chess.White {
+				letter = strings.ToUpper(letter)
+			}
+			castling.WriteString(letter)
+		}
+	}
+	if castling.Len() == 0 {
+		return "-"
+	}
+	return castling.String()
+}
+
+// fen returns the FEN of the position with X-FEN castling rights, with the
+// pockets and promoted pieces if the variant has drops, and with the checks
+// left if the variant counts them.
+func (p *variantPosition) fen() string {
+	fields := strings.Fields(p.position.String())
+	fields[2] = p.xfenCastling()
+	if p.pockets != nil {
+		fields[0] = boardFEN(p.position.Board(), p.promoted) + "[" + pocketString(p.pockets) + "]"
+	}
+	if p.checksLeft != nil {
+		fields = append(fields[:4], checksField(p.checksLeft), fields[4], fields[5])
+	}
+	return strings.Join(fields, " ")
+}
+
+// withoutCastling returns the castling rights without the rights of the
+// rooks that drop returns true for.
+func (p *variantPosition) withoutCastling(drop func(rook chess.Square) bool) string {
+	var castling strings.Builder
+	for _, r := range p.castling {
+		if rook, _ := castlingRook(r); !drop(rook) {
+			castling.WriteRune(r)
+		}
+	}
+	return castling.String()
+}
+
+// backRank returns the rank that the pieces of the colour start on.
+func backRank(color chess.Color) chess.Rank {
+	if color == chess.Black {
+		return chess.Rank8
+	}
+	return chess.Rank1
+}
+
+// squareAttacked returns whether any piece of the colour attacks the square.
+func squareAttacked(board *chess.Board, sq chess.Square, by chess.Color) bool {
+	file, rank := int(sq.File()), int(sq.Rank())
+	pieceAt := func(f, r int) chess.Piece {
+		if f < 0 || f > 7 || r < 0 || r > 7 {
+			return chess.NoPiece
+		}
+		return board.Piece(chess.NewSquare(chess.File(f), chess.Rank(r)))
+	}
+
+	pawnRank := rank - 1
+	if by == chess.Black {
+		pawnRank = rank + 1
+	}
+	pawn := chess.NewPiece(chess.Pawn, by)
+	if pieceAt(file-1, pawnRank) == pawn || pieceAt(file+1, pawnRank) == pawn {
+		return true
+	}
+
+	knight, king := chess.NewPiece(chess.Knight, by), chess.NewPiece(chess.King, by)
+	for _, d := range [][2]int{{1, 2}, {2, 1}, {2, -1}, {1, -2}, {-1, -2}, {-2, -1}, {-2, 1}, {-1, 2}} {
+		if pieceAt(file+d[0], rank+d[1]) == knight {
+			return true
+		}
+	}
+	for _, d := range [][2]int{{1, 0}, {1, 1}, {0, 1}, {-1, 1}, {-1, 0}, {-1, -1}, {0, -1}, {1, -1}} {
+		if pieceAt(file+d[0], rank+d[1]) == king {
+			return true
+		}
+	}
+
+	queen := chess.NewPiece(chess.Queen, by)
+	sliders := []struct {
+		directions [][2]int
+		piece      chess.Piece
+	}{
+		{[][2]int{{1, 0}, {0, 1}, {-1, 0}, {0, -1}}, chess.NewPiece(chess.Rook, by)},
+		{[][2]int{{1, 1}, {-1, 1}, {-1, -1}, {1, -1}}, chess.NewPiece(chess.Bishop, by)},
+	}
+	for _, slider := range sliders {
+		for _, d := range slider.directions {
+			for f, r := file+d[0], rank+d[1]; f >= 0 && f <= 7 && r >= 0 && r <= 7; f, r = f+d[0], r+d[1] {
+				piece := pieceAt(f, r)
+				if piece == chess.NoPiece {
+					continue
+				}
+				if piece == slider.piece || piece == queen {
+					return true
+				}
+				break
+			}
+		}
+	}
+	return false
+}
+
+// inCheck returns whether the side to move is in check.
+func inCheck(position *chess.Position) bool {
+	king := chess.NewPiece(chess.King, position.Turn())
+	for sq, piece := range position.Board().SquareMap() {
+		if piece == king {
+			return squareAttacked(position.Board(), sq, position.Turn().Other())
+		}
+	}
+	return false
+}
+
+// castleMoves returns the legal castling moves of the side to move. The
+// squares between the king and the rook and their destinations must be empty,
+// and the king may not be in check, pass through an attacked square or end up
+// in check.
+func (p *variantPosition) castleMoves() []*castleMove {
+	turn := p.position.Turn()
+	king, ok := p.backRankKing(turn)
+	if !ok || inCheck(p.position) {
+		return nil
+	}
+	board := p.position.Board()
+	rank := king.Rank()
+
+	castles := make([]*castleMove, 0, 2)
+	for _, rook := range p.castlingRooks(turn) {
+		castle := castleMove{
+			side:   chess.KingSide,
+			king:   king,
+			rook:   rook,
+			kingTo: chess.NewSquare(chess.FileG, rank),
+			rookTo: chess.NewSquare(chess.FileF, rank),
+		}
+		if rook.File() < king.File() {
+			castle.side = chess.QueenSide
+			castle.kingTo = chess.NewSquare(chess.FileC, rank)
+			castle.rookTo = chess.NewSquare(chess.FileD, rank)
+		}
+
+		from, to := king.File(), king.File()
+		for _, sq := range []chess.Square{castle.kingTo, castle.rook, castle.rookTo} {
+			if sq.File() < from {
+				from = sq.File()
+			}
+			if sq.File() > to {
+				to = sq.File()
+			}
+		}
+		legal := true
+		for f := from; f <= to; f++ {
+			sq := chess.NewSquare(f, rank)
+			if sq != king && sq != rook && board.Piece(sq) != chess.NoPiece {
+				legal = false
+			}
+		}
+		step := chess.File(1)
+		if castle.kingTo.File() < king.File() {
+			step = -1
+		}
+		for f := king.File(); legal; f += step {
+			if squareAttacked(board, chess.NewSquare(f, rank), turn.Other()) {
+				legal = false
+			}
+			if f == castle.kingTo.File() {
+				break
+			}
+		}
+		// The castling rook may have been shielding the king.
+		if legal && squareAttacked(p.castle(&castle).position.Board(), castle.kingTo, turn.Other()) {
+			legal = false
+		}
+		if legal {
+			castles = append(castles, &castle)
+		}
+	}
+	return castles
+}
+
+// successor returns the position with the board after a castling move or a
+// drop, which notnil/chess can't play and which don't reset the halfmove
+// clock. The castling rights, pockets and promoted pieces are copied for the
+// caller to update.
+func (p *variantPosition) successor(squares map[chess.Square]chess.Piece) *variantPosition {
+	turn := p.position.Turn()
+	moveCount := moveNumber(p.position)
+	if turn == chess.Black {
+		moveCount++
+	}
+	fen := fmt.Sprintf("%s %s - - %d %d", chess.NewBoard(squares).String(), turn.Other(), p.position.HalfMoveClock()+1, moveCount)
+	var position chess.Position
+	if err := position.UnmarshalText([]byte(fen)); err != nil {
+		// The board comes from a valid position, so this can't happen.
+		panic(err)
+	}
+	return &variantPosition{
+		position: &position,
+		castling: p.castling,
+		pockets:  copyPockets(p.pockets),
+		promoted: copyPromoted(p.promoted),
+	}
+}
+
+// castle returns the position after the castling move.
+func (p *variantPosition) castle(castle *castleMove) *variantPosition {
+	squares := p.position.Board().SquareMap()
+	kingPiece, rookPiece := squares[castle.king], squares[castle.rook]
+	delete(squares, castle.king)
+	delete(squares, castle.rook)
+	squares[castle.kingTo] = kingPiece
+	squares[castle.rookTo] = rookPiece
+
+	turn := p.position.Turn()
+	next := p.successor(squares)
+	next.castling = p.withoutCastling(func(rook chess.Square) bool { return rook.Rank() == backRank(turn) })
+	return next
+}
+
+// play returns the position after the move, counting it if it gives check
+// in a variant that counts checks.
+func (p *variantPosition) play(move variantMove) *variantPosition {
+	next := p.playMove(move)
+	if p.checksLeft != nil {
+		next.checksLeft = map[chess.Color]int{}
+		for color, n := range p.checksLeft {
+			next.checksLeft[color] = n
+		}
+		if inCheck(next.position) {
+			next.checksLeft[p.position.Turn()]--
+		}
+	}
+	return next
+}
+
+func (p *variantPosition) playMove(move variantMove) *variantPosition {
+	if move.castle != nil {
+		return p.castle(move.castle)
+	}
+	if move.drop != nil {
+		return p.playDrop(move.drop)
+	}
+	// Moving the king loses both castling rights, and moving a rook or
+	// capturing it loses its right.
+	turn := p.position.Turn()
+	kingMoved := p.position.Board().Piece(move.move.S1()).Type() == chess.King
+	castling := p.withoutCastling(func(rook chess.Square) bool {
+		return (kingMoved && rook.Rank() == backRank(turn)) || rook == move.move.S1() || rook == move.move.S2()
+	})
+	next := &variantPosition{position: p.position.Update(move.move), castling: castling}
+	if p.pockets != nil {
+		next.pockets, next.promoted = p.pocketsAfter(move.move)
+	}
+	return next
+}
+
+// validMoves returns the legal moves of the position.
+func (p *variantPosition) validMoves() []variantMove {
+	moves := make([]variantMove, 0)
+	for _, move := range p.position.ValidMoves() {
+		moves = append(moves, variantMove{move: move})
+	}
+	for _, castle := range p.castleMoves() {
+		moves = append(moves, variantMove{castle: castle})
+	}
+	for _, drop := range p.dropMoves() {
+		moves = append(moves, variantMove{drop: drop})
+	}
+	return moves
+}
+
+// san returns the move in SAN. notnil/chess doesn't know about drops, which
+// can block a check, so the check and checkmate signs are worked out here.
+func (p *variantPosition) san(move variantMove) string {
+	var san string
+	switch {
+	case move.castle != nil:
+		san = "O-O"
+		if move.castle.side == chess.QueenSide {
+			san = "O-O-O"
+		}
+	case move.drop != nil:
+		san = strings.ToUpper(move.drop.piece.Type().String()) + "@" + move.drop.square.String()
+	default:
+		san = strings.TrimRight(chess.AlgebraicNotation{}.Encode(p.position, move.move), "+#")
+	}
+	next := p.play(move)
+	if inCheck(next.position) {
+		if len(next.validMoves()) == 0 {
+			return san + "#"
+		}
+		return san + "+"
+	}
+	return san
+}
+
+// chessMove returns a notnil move that stands for the variant move, for
+// highlighting it on the board. A castling move is shown as the move of the
+// king, or of the rook if the king doesn't move, and a drop as a move from
+// the square to itself.
+func (move variantMove) chessMove() *chess.Move {
+	if move.drop != nil {
+		m, _ := chess.UCINotation{}.Decode(nil, move.drop.square.String()+move.drop.square.String())
+		return m
+	}
+	if move.castle == nil {
+		return move.move
+	}
+	from, to := move.castle.king, move.castle.kingTo
+	if from == to {
+		from, to = move.castle.rook, move.castle.rookTo
+	}
+	m, _ := chess.UCINotation{}.Decode(nil, from.String()+to.String())
+	return m
+}
+
+// repetitionKey returns the parts of the FEN that decide whether two
+// positions are the same for the repetition rules: everything but the move
+// counters. That includes the pockets, which are part of the board field,
+// and the checks that each side still has to give.
+func (p *variantPosition) repetitionKey() string {
+	fields := strings.Fields(p.fen())
+	return strings.Join(fields[:len(fields)-2], " ")
+}
+
+// parseMove finds the legal move written in SAN, in UCI notation, as
+// castling with the letter O or the digit 0, or as a drop like N@f3.
+func (p *variantPosition) parseMove(s string) (variantMove, error) {
+	s = strings.TrimSpace(s)
+	moves := p.validMoves()
+	if match := dropInputRegex.FindStringSubmatch(s); match != nil {
+		return p.parseDrop(match[1], match[2], moves)
+	}
+	if castlingInputRegex.MatchString(s) {
+		side := chess.KingSide
+		if strings.Count(strings.ToUpper(strings.ReplaceAll(s, "0", "O")), "O") == 3 {
+			side = chess.QueenSide
+		}
+		for _, move := range moves {
+			if move.castle != nil && move.castle.side == side {
+				return move, nil
+			}
+		}
+		return variantMove{}, fmt.Errorf("can't castle %s", s)
+	}
+
+	if m, err := (chess.AlgebraicNotation{}).Decode(p.position, s); err == nil {
+		return variantMove{move: m}, nil
+	}
+	if m, err := (chess.UCINotation{}).Decode(nil, s); err == nil {
+		for _, move := range moves {
+			if move.castle != nil && m.S1() == move.castle.king && m.S2() == move.castle.rook {
+				return move, nil
+			}
+			if move.move != nil && move.move.S1() == m.S1() && move.move.S2() == m.S2() && move.move.Promo() == m.Promo() {
+				return move, nil
+			}
+		}
+	}
+	return variantMove{}, fmt.Errorf("invalid move %s", s)
+}
+
+// Variant returns the variant whose rules the game follows.
+func (g *VariantGame) Variant() Variant {
+	return g.variant
+}
+
+func (g *VariantGame) current() *variantPosition {
+	return g.positions[len(g.positions)-1]
+}
+
+// MoveStr plays the move written in SAN or UCI notation.
+func (g *VariantGame) MoveStr(s string) error {
+	if g.outcome != chess.NoOutcome {
+		return errors.New("the game is over")
+	}
+	move, err := g.current().parseMove(s)
+	if err != nil {
+		return err
+	}
+	g.play(move)
+	return nil
+}
+
+func (g *VariantGame) play(move variantMove) {
+	previous := g.current()
+	next := previous.play(move)
+	if passesCaptures(g.variant) && move.move != nil {
+		// The captured piece goes to the partner on the other board instead.
+		if captured := previous.capturedType(move.move); captured != chess.NoPieceType {
+			next.removeFromPocket(chess.NewPiece(captured, previous.position.Turn()))
+		}
+	}
+	g.sans = append(g.sans, previous.san(move))
+	g.moves = append(g.moves, move.chessMove())
+	g.nags = append(g.nags, nil)
+	g.comments = append(g.comments, nil)
+	g.positions = append(g.positions, next)
+	g.updateOutcome()
+}
+
+// updateOutcome ends the game if the variant's own rules end it, or if the
+// current position is checkmate, stalemate or an automatic draw.
+func (g *VariantGame) updateOutcome() {
+	current := g.current()
+	if outcome, termination := g.variant.Outcome(current); outcome != chess.NoOutcome {
+		g.outcome, g.method, g.termination = outcome, chess.NoMethod, termination
+		return
+	}
+	if len(current.validMoves()) == 0 {
+		if inCheck(current.position) {
+			g.method = chess.Checkmate
+			g.outcome = chess.WhiteWon
+			if current.position.Turn() == chess.White {
+				g.outcome = chess.BlackWon
+			}
+		} else {
+			g.method = chess.Stalemate
+			g.outcome = chess.Draw
+		}
+		return
+	}
+
+	repetitions := 0
+	for _, p := range g.positions {
+		if p.repetitionKey() == current.repetitionKey() {
+			repetitions++
+		}
+	}
+	if repetitions >= 5 {
+		g.method, g.outcome = chess.FivefoldRepetition, chess.Draw
+	} else if current.position.HalfMoveClock() >= 150 {
+		g.method, g.outcome = chess.SeventyFiveMoveRule, chess.Draw
+	} else if !g.variant.InsufficientMaterialDraws() {
+		return
+	} else if fen, err := chess.FEN(current.position.String()); err == nil && chess.NewGame(fen).Method() == chess.InsufficientMaterial {
+		g.method, g.outcome = chess.InsufficientMaterial, chess.Draw
+	}
+}
+
+// FEN returns the FEN of the current position with X-FEN castling rights.
+func (g *VariantGame) FEN() string {
+	return g.current().fen()
+}
+
+// PositionFEN returns the FEN of the position after the number of plies.
+func (g *VariantGame) PositionFEN(ply int) string {
+	return g.positions[ply].fen()
+}
+
+// SAN returns the move with the index in SAN.
+func (g *VariantGame) SAN(i int) string {
+	return g.sans[i]
+}
+
+func (g *VariantGame) Position() *chess.Position {
+	return g.current().position
+}
+
+func (g *VariantGame) Positions() []*chess.Position {
+	positions := make([]*chess.Position, 0, len(g.positions))
+	for _, p := range g.positions {
+		positions = append(positions, p.position)
+	}
+	return positions
+}
+
+func (g *VariantGame) Moves() []*chess.Move {
+	return append([]*chess.Move(nil), g.moves...)
+}
+
+func (g *VariantGame) Comments() [][]string {
+	return append([][]string(nil), g.comments...)
+}
+
+func (g *VariantGame) Outcome() chess.Outcome {
+	return g.outcome
+}
+
+func (g *VariantGame) Method() chess.Method {
+	return g.method
+}
+
+// AddTagPair adds or updates the tag pair and returns true if it was already
+// present.
+func (g *VariantGame) AddTagPair(k, v string) bool {
+	for _, tag := range g.tagPairs {
+		if tag.Key == k {
+			tag.Value = v
+			return true
+		}
+	}
+	g.tagPairs = append(g.tagPairs, &chess.TagPair{Key: k, Value: v})
+	return false
+}
+
+func (g *VariantGame) GetTagPair(k string) *chess.TagPair {
+	for _, tag := range g.tagPairs {
+		if tag.Key == k {
+			return tag
+		}
+	}
+	return nil
+}
+
+func (g *VariantGame) RemoveTagPair(k string) bool {
+	for i, tag := range g.tagPairs {
+		if tag.Key == k {
+			g.tagPairs = append(g.tagPairs[:i], g.tagPairs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (g *VariantGame) TagPairs() []*chess.TagPair {
+	return append([]*chess.TagPair(nil), g.tagPairs...)
+}
+
+// String returns the PGN of the game. Unlike notnil/chess, it numbers the
+// moves from the move number of the starting position.
+func (g *VariantGame) String() string {
+	var pgn strings.Builder
+	for _, tag := range g.tagPairs {
+		fmt.Fprintf(&pgn, "[%s \"%s\"]\n", tag.Key, tag.Value)
+	}
+	pgn.WriteString("\n")
+	writeMovetext(&pgn, g.Positions(), g.sans, g.nags, g.comments, g.outcome)
+	return pgn.String()
+}
+
+var (
+	variantTagRegex   = regexp.MustCompile(`\[(\w+)\s+"((?:[^"\\]|\\.)*)"\]`)
+	variantTokenRegex = regexp.MustCompile(`\{([^}]*)\}|;[^\n]*|\([^)]*\)|\$\d+|\d+\.(?:\.\.)?|(\*|1-0|0-1|1/2-1/2)|([^\s{}();]+)`)
+)
+
+// ParseVariantPGN parses the PGN of a game of a variant written by
+// VariantGame.String, or by another program that uses X-FEN or Shredder-FEN.
+// The rules are those of the variant in the Variant tag. Variations are
+// skipped.
+func ParseVariantPGN(pgn string) (*VariantGame, error) {
+	name := ""
+	for _, tag := range variantTagRegex.FindAllStringSubmatch(pgn, -1) {
+		if tag[1] == "Variant" {
+			name = tag[2]
+		}
+	}
+	return parseVariantPGN(lookupVariant(name), pgn)
+}
+
+// parseVariantPGN parses the PGN of a game with the rules of the variant,
+// whatever its Variant tag says.
+func parseVariantPGN(variant Variant, pgn string) (*VariantGame, error) {
+	tags := variantTagRegex.FindAllStringSubmatch(pgn, -1)
+	fen := variant.StartingFEN()
+	for _, tag := range tags {
+		if tag[1] == "FEN" {
+			fen = tag[2]
+		}
+	}
+	game, err := NewVariantGame(variant, fen)
+	if err != nil {
+		return nil, err
+	}
+	game.tagPairs = nil
+	for _, tag := range tags {
+		game.AddTagPair(tag[1], tag[2])
+	}
+
+	for _, token := range variantTokenRegex.FindAllStringSubmatch(pgnMovetext(pgn), -1) {
+		switch {
+		case strings.HasPrefix(token[0], "{"):
+			if len(game.comments) > 0 {
+				game.comments[len(game.comments)-1] = append(game.comments[len(game.comments)-1], strings.TrimSpace(token[1]))
+			}
+		case strings.HasPrefix(token[0], "$"):
+			if nag, ok := parseNAG(token[0]); ok && len(game.nags) > 0 {
+				game.nags[len(game.nags)-1] = append(game.nags[len(game.nags)-1], nag)
+			}
+		case token[2] != "":
+			game.outcome = chess.Outcome(token[2])
+		case token[3] != "":
+			san, nag := splitGlyph(token[3])
+			move, err := game.current().parseMove(san)
+			if match := dropInputRegex.FindStringSubmatch(token[3]); err != nil && match != nil && passesCaptures(variant) {
+				// The PGN of one board doesn't show the pieces that came
+				// from the other board, so they are assumed to have come
+				// just in time.
+				game.AddToPocket(chess.NewPiece(dropPieceType(match[1]), game.Position().Turn()))
+				move, err = game.current().parseMove(token[3])
+			}
+			if err != nil {
+				return nil, fmt.Errorf("move %d: %w", len(game.moves)+1, err)
+			}
+			game.play(move)
+			if nag != 0 {
+				game.nags[len(game.nags)-1] = []int{nag}
+			}
+		}
+	}
+	return game, nil
+}
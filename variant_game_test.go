@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/notnil/chess"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+func TestParseVariantFEN(t *testing.T) {
+	testCases := []struct {
+		name string
+		fen  string
+		want string
+	}{
+		{"standard", "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1", ""},
+		{"Chess960 position 0", chess960FEN(0), ""},
+		{"inner rook", "4k3/8/8/8/8/8/8/RR1K4 w B - 0 1", ""},
+		{"outer rook", "4k3/8/8/8/8/8/8/RR1K4 w Q - 0 1", ""},
+		{"Shredder-FEN", "rk5r/8/8/8/8/8/8/RK5R w HAha - 0 1", "rk5r/8/8/8/8/8/8/RK5R w KQkq - 0 1"},
+		{"no move counters", "rk5r/8/8/8/8/8/8/RK5R b Kq -", "rk5r/8/8/8/8/8/8/RK5R b Kq - 0 1"},
+		{"pockets", "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR[Pp] w KQkq - 0 1", ""},
+		{"empty pockets", "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR[] w KQkq - 0 1", ""},
+		{"pockets as a ninth rank", "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR/Pp w KQkq - 0 1", "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR[Pp] w KQkq - 0 1"},
+		{"promoted piece", "rnbqkb1r/pppppppp/8/8/8/8/PPPPPPPP/RNBQ~KBNR[Pp] w KQkq - 0 1", ""},
+		{"checks left", "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 3+3 0 1", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			want := tc.want
+			if want == "" {
+				want = tc.fen
+			}
+			position, err := parseVariantFEN(tc.fen)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fen := position.fen(); fen != want {
+				t.Errorf("parseVariantFEN(%q).fen() = %q, want %q", tc.fen, fen, want)
+			}
+		})
+	}
+}
+
+func TestChess960Castling(t *testing.T) {
+	testCases := []struct {
+		name string
+		fen  string
+		move string
+		// want is the FEN after the move, or empty if the move is illegal.
+		want string
+	}{
+		{"queenside from b1", "4k3/8/8/8/8/8/8/RK5R w KQ - 0 1", "O-O-O", "4k3/8/8/8/8/8/8/2KR3R b - - 1 1"},
+		{"kingside from b1", "4k3/8/8/8/8/8/8/RK5R w KQ - 0 1", "O-O", "4k3/8/8/8/8/8/8/R4RK1 b - - 1 1"},
+		{"king already on g1", "4k3/8/8/8/8/8/8/6KR w K - 0 1", "O-O", "4k3/8/8/8/8/8/8/5RK1 b - - 1 1"},
+		{"Black keeps White's rights", "rk5r/8/8/8/8/8/8/RK5R b KQkq - 0 1", "O-O-O", "2kr3r/8/8/8/8/8/8/RK5R w KQ - 1 2"},
+		{"blocked", "4k3/8/8/8/8/8/8/5KNR w K - 0 1", "O-O", ""},
+		{"through check", "4r1k1/8/8/8/8/8/8/1K5R w K - 0 1", "O-O", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			game, err := NewVariantGame(chess960Variant{}, tc.fen)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = game.MoveStr(tc.move)
+			switch {
+			case tc.want == "" && err == nil:
+				t.Errorf("%s was played in %q", tc.move, tc.fen)
+			case tc.want != "" && err != nil:
+				t.Errorf("%s in %q: %v", tc.move, tc.fen, err)
+			case tc.want != "" && game.FEN() != tc.want:
+				t.Errorf("FEN after %s = %q, want %q", tc.move, game.FEN(), tc.want)
+			}
+			if tc.want == "" {
+				return
+			}
+
+			// The game survives a round trip through its PGN.
+			parsed, err := ParseVariantPGN(game.String())
+			if err != nil {
+				t.Fatalf("ParseVariantPGN(%q): %v", game.String(), err)
+			}
+			if parsed.FEN() != tc.want {
+				t.Errorf("FEN after parsing the PGN = %q, want %q", parsed.FEN(), tc.want)
+			}
+		})
+	}
+}
+
+func TestVariantGameThreefoldRepetition(t *testing.T) {
+	testCases := []struct {
+		name     string
+		moves    string
+		eligible bool
+	}{
+		{"repeated position", "Nf3 Nf6 Ng1 Ng8 Nf3 Nf6 Ng1 Ng8", true},
+		{"checks given in between", "e4 d5 Bd3 h6 Bb5+ Nc6 Bd3 Nb8 Bb5+ Nc6 Bd3 Nb8", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			game, err := NewVariantGame(threeCheckVariant{}, threeCheckVariant{}.StartingFEN())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, move := range strings.Fields(tc.moves) {
+				if err := game.MoveStr(move); err != nil {
+					t.Fatalf("move %s: %v", move, err)
+				}
+			}
+			eligible := false
+			for _, method := range game.EligibleDraws() {
+				eligible = eligible || method == chess.ThreefoldRepetition
+			}
+			if eligible != tc.eligible {
+				t.Errorf("threefold repetition eligible = %v, want %v", eligible, tc.eligible)
+			}
+		})
+	}
+}
+
+func TestCrazyhouseDropRoundTrip(t *testing.T) {
+	testCases := []struct {
+		name  string
+		moves string
+		// pocket is the pockets after the moves, as written in a FEN.
+		pocket string
+	}{
+		{"pawn drop", "e4 d5 exd5 Qxd5 Nc3 Qa5 P@d4", "p"},
+		{"knight drop", "Nf3 e5 Nxe5 Nc6 Nxc6 dxc6 N@e5", "Pn"},
+		{"drop with check", "e4 f5 exf5 e6 fxe6 d6 P@f7+", "P"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			game, err := NewVariantGame(crazyhouseVariant{}, crazyhouseStartingFEN)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, move := range strings.Fields(tc.moves) {
+				if err := game.MoveStr(move); err != nil {
+					t.Fatalf("move %s: %v", move, err)
+				}
+			}
+			if pocket := game.PocketString(); pocket != tc.pocket {
+				t.Errorf("pockets after the moves = %q, want %q", pocket, tc.pocket)
+			}
+
+			parsed, err := ParseVariantPGN(game.String())
+			if err != nil {
+				t.Fatalf("ParseVariantPGN(%q): %v", game.String(), err)
+			}
+			if parsed.FEN() != game.FEN() {
+				t.Errorf("FEN after parsing the PGN = %q, want %q", parsed.FEN(), game.FEN())
+			}
+			if parsed.PocketString() != tc.pocket {
+				t.Errorf("pockets after parsing the PGN = %q, want %q", parsed.PocketString(), tc.pocket)
+			}
+		})
+	}
+}
+
+func TestBughouseCaptureGoesToPartner(t *testing.T) {
+	roomID := mid.RoomID("!room:test")
+	// White and Black on board 1 are partnered with Black and White on
+	// board 2.
+	white1, black1 := mid.UserID("@white1:test"), mid.UserID("@black1:test")
+	white2, black2 := mid.UserID("@white2:test"), mid.UserID("@black2:test")
+	type move struct {
+		player mid.UserID
+		move   string
+	}
+	testCases := []struct {
+		name  string
+		moves []move
+		// pockets are the pockets on each board after the moves.
+		pockets [2]string
+		// pgn2 is a move expected in the PGN of board 2.
+		pgn2 string
+	}{
+		{"capture on board 1", []move{{white1, "e4"}, {black1, "d5"}, {white1, "exd5"}}, [2]string{"", "p"}, ""},
+		{"capture on board 2", []move{{white2, "e4"}, {black2, "d5"}, {white2, "exd5"}}, [2]string{"p", ""}, ""},
+		{"partner drops the capture", []move{{white1, "e4"}, {black1, "d5"}, {white1, "exd5"}, {white2, "e4"}, {black2, "P@d5"}}, [2]string{"", ""}, "P@d5"},
+		{"not the player's turn", []move{{black1, "e5"}}, [2]string{"", ""}, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			setUpTestApp(t)
+			handleNewBughouseCommand(roomID, []string{string(white1), string(black2), "vs", string(black1), string(white2)}, StateChessGameEventContent{TimeControl: "-"})
+			for i, m := range tc.moves {
+				gameState, err := getGameStateEvent(roomID)
+				if err != nil || gameState.Bughouse == nil {
+					t.Fatalf("the Bughouse match didn't start: %v", err)
+				}
+				event := &mevent.Event{RoomID: roomID, Sender: m.player, ID: mid.EventID(fmt.Sprintf("$move%d", i))}
+				handleBughouseMove(event, gameState, m.move)
+			}
+
+			gameState, err := getGameStateEvent(roomID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pockets := [2]string{gameState.Pockets, gameState.Bughouse.Pockets}; pockets != tc.pockets {
+				t.Errorf("pockets = %q, want %q", pockets, tc.pockets)
+			}
+			if tc.pgn2 != "" && !strings.Contains(gameState.Bughouse.PGN, tc.pgn2) {
+				t.Errorf("PGN of board 2 %q doesn't have %s", gameState.Bughouse.PGN, tc.pgn2)
+			}
+		})
+	}
+}
+
+func TestTakeBack(t *testing.T) {
+	testCases := []struct {
+		name    string
+		newGame func() (Game, error)
+		// moves are played in order, and the last one is taken back.
+		moves []string
+	}{
+		{"standard", func() (Game, error) { return parseStandardPGN("*") }, []string{"e4 !? {main idea}", "d5", "exd5 ? {too greedy}"}},
+		{"standard first move", func() (Game, error) { return parseStandardPGN("*") }, []string{"d4 {opening}"}},
+		{"crazyhouse capture", func() (Game, error) {
+			return NewVariantGame(crazyhouseVariant{}, crazyhouseStartingFEN)
+		}, []string{"e4 {main idea}", "d5 !", "exd5 ?"}},
+		{"crazyhouse drop", func() (Game, error) {
+			return NewVariantGame(crazyhouseVariant{}, crazyhouseStartingFEN)
+		}, []string{"e4", "d5", "exd5 {pawn up}", "Qxd5", "Nc3", "Qa5", "P@d4 !!"}},
+		{"checkmate", func() (Game, error) { return parseStandardPGN("*") }, []string{"f3", "e5", "g4", "Qh4#"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			game, err := tc.newGame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var before string
+			for i, body := range tc.moves {
+				if i == len(tc.moves)-1 {
+					before = game.String()
+				}
+				move, annotation := parseAnnotatedMove(body)
+				if err := game.MoveStr(move); err != nil {
+					t.Fatalf("move %s: %v", move, err)
+				}
+				annotateLastMove(game, annotation)
+			}
+
+			if err := takeBack(game); err != nil {
+				t.Fatal(err)
+			}
+			if game.String() != before {
+				t.Errorf("PGN after the takeback = %q, want %q", game.String(), before)
+			}
+			if game.Outcome() != chess.NoOutcome {
+				t.Errorf("outcome after the takeback = %s, want none", game.Outcome())
+			}
+			if len(game.Comments()) != len(game.Moves()) {
+				t.Errorf("%d comments for %d moves", len(game.Comments()), len(game.Moves()))
+			}
+		})
+	}
+}
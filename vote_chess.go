@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/notnil/chess"
+	log "github.com/sirupsen/logrus"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// defaultVoteWindow is how long the room has to vote on each of its moves,
+// unless the configuration says otherwise.
+const defaultVoteWindow = 5 * time.Minute
+
+// maxPollAnswers is the most moves that a poll offers. Any other legal move
+// can still be voted for by sending it.
+const maxPollAnswers = 20
+
+// voteReaction acknowledges a vote sent as a message.
+const voteReaction = "🗳️"
+
+// VoteChess is the side that the whole room plays in a vote chess game, by
+// voting on each of its moves, against a player or the engine.
+type VoteChess struct {
+	// Side is the colour that the room plays, "White" or "Black".
+	Side string
+
+	// Opponent plays the other side, which the engine plays if it is empty.
+	Opponent mid.UserID
+
+	// PollEventID is the poll on the room's current move, which closes at
+	// Closes. It is empty while the opponent is to move.
+	PollEventID mid.EventID
+	Closes      time.Time
+}
+
+func (v *VoteChess) color() chess.Color {
+	if v.Side == colorName(chess.Black) {
+		return chess.Black
+	}
+	return chess.White
+}
+
+// voteLock serialises counting votes and closing polls, so that a vote isn't
+// lost while the poll that it is for closes.
+var voteLock sync.Mutex
+
+func voteWindow() time.Duration {
+	if App.configuration.VoteWindowSeconds > 0 {
+		return time.Duration(App.configuration.VoteWindowSeconds) * time.Second
+	}
+	return defaultVoteWindow
+}
+
+// describeWindow writes the duration in minutes, or in seconds if it is
+// shorter than a minute.
+func describeWindow(window time.Duration) string {
+	if window < time.Minute {
+		return fmt.Sprintf("%d seconds", int(window.Seconds()))
+	} else if window < 2*time.Minute {
+		return "1 minute"
+	}
+	return fmt.Sprintf("%d minutes", int(window.Minutes()))
+}
+
+// handleNewVoteCommand starts a vote chess game, where the room plays a side
+// against the opponent. Vote chess games are never rated.
+func handleNewVoteCommand(roomID mid.RoomID, args []string, gameState StateChessGameEventContent) {
+	usage := "Usage: new [minutes+increment] vote [white|black] @opponent|engine. The room plays the side, White by default, by voting on each of its moves."
+	args = nonEmpty(args)
+	vote := VoteChess{Side: colorName(chess.White)}
+	if len(args) == 2 {
+		switch strings.ToLower(args[0]) {
+		case "white":
+		case "black":
+			vote.Side = colorName(chess.Black)
+		default:
+			SendNotice(roomID, usage)
+			return
+		}
+		args = args[1:]
+	}
+	switch {
+	case len(args) != 1:
+		SendNotice(roomID, usage)
+		return
+	case strings.EqualFold(args[0], "engine"):
+		if App.analyzer == nil {
+			SendNotice(roomID, "There is no engine to play against. Set engine_path in the configuration to use one.")
+			return
+		}
+	case strings.HasPrefix(args[0], "@"):
+		vote.Opponent = mid.UserID(args[0])
+	default:
+		SendNotice(roomID, usage)
+		return
+	}
+
+	gameState.Rated = false
+	gameState.Vote = &vote
+	if vote.Opponent != "" {
+		gameState.SetPlayer(vote.color().Other(), vote.Opponent)
+	}
+	game := chess.NewGame()
+	startGame(roomID, game, gameState)
+
+	// The board image of the game is only known once it has been saved.
+	saved, err := getGameStateEvent(roomID)
+	if err != nil || saved.GameID != gameState.GameID {
+		log.Errorf("Failed to start vote chess game %s: %v", gameState.GameID, err)
+		return
+	}
+	nextVoteTurn(roomID, saved, game)
+}
+
+// nextVoteTurn opens the vote on the room's move if it is the room's turn,
+// and plays the engine's move if it is the engine's turn.
+func nextVoteTurn(roomID mid.RoomID, gameState *StateChessGameEventContent, game Game) {
+	vote := gameState.Vote
+	if vote == nil || game.Outcome() != chess.NoOutcome {
+		return
+	}
+	switch {
+	case game.Position().Turn() == vote.color():
+		openVote(roomID, gameState, game)
+	case vote.Opponent == "":
+		playEngineMove(roomID, gameState, game)
+	}
+}
+
+// playEngineMove plays the engine's move against the room.
+func playEngineMove(roomID mid.RoomID, gameState *StateChessGameEventContent, game Game) {
+	if App.analyzer == nil {
+		SendNotice(roomID, "The engine isn't available any more, so the game can't go on.")
+		return
+	}
+	move, err := App.analyzer.BestMove(game.Position())
+	if err != nil {
+		log.Errorf("Failed to find the engine's move in game %s: %v", gameState.GameID, err)
+		return
+	}
+	if err := game.MoveStr(chess.AlgebraicNotation{}.Encode(game.Position(), move)); err != nil {
+		log.Errorf("Failed to play the engine's move in game %s: %v", gameState.GameID, err)
+		return
+	}
+	showMove(roomID, "", gameState, game)
+}
+
+// candidateMoves returns the moves that the poll offers, in SAN. If there are
+// too many legal moves, checks and captures come first.
+func candidateMoves(position *chess.Position) []string {
+	moves := position.ValidMoves()
+	forcing := func(move *chess.Move) bool {
+		return move.HasTag(chess.Check) || move.HasTag(chess.Capture)
+	}
+	sort.SliceStable(moves, func(i, j int) bool {
+		return forcing(moves[i]) && !forcing(moves[j])
+	})
+	if len(moves) > maxPollAnswers {
+		moves = moves[:maxPollAnswers]
+	}
+	sans := make([]string, 0, len(moves))
+	for _, move := range moves {
+		sans = append(sans, chess.AlgebraicNotation{}.Encode(position, move))
+	}
+	return sans
+}
+
+// openVote opens the poll on the room's move, replacing any poll that is
+// still open.
+func openVote(roomID mid.RoomID, gameState *StateChessGameEventContent, game Game) {
+	vote := gameState.Vote
+	position := game.Position()
+	window := voteWindow()
+	question := fmt.Sprintf("Vote for %s's move %s The vote closes in %s. To vote for a move that isn't in the poll, send it in SAN.", vote.Side, moveLabel(position), describeWindow(window))
+	resp, err := SendPoll(roomID, question, candidateMoves(position))
+	if err != nil {
+		return
+	}
+	if vote.PollEventID != "" {
+		EndPoll(roomID, vote.PollEventID, "This vote was replaced by a new one.")
+	}
+	vote.PollEventID, vote.Closes = resp.EventID, time.Now().Add(window)
+	if _, err := App.client.SendStateEvent(roomID, StateChessGame, "", gameState); err != nil {
+		log.Errorf("Failed to save game %s: %v", gameState.GameID, err)
+		return
+	}
+	scheduleVoteClose(roomID, vote.PollEventID, vote.Closes)
+}
+
+func scheduleVoteClose(roomID mid.RoomID, pollEventID mid.EventID, closes time.Time) {
+	time.AfterFunc(time.Until(closes), func() { closeVote(roomID, pollEventID) })
+}
+
+// resumeVoteGames picks the vote chess games in the joined rooms back up after
+// a restart, since the timers that close their polls are gone. Polls that are
+// overdue close straight away, and the engine plays if it is its turn.
+func resumeVoteGames() {
+	joined, err := App.client.JoinedRooms()
+	if err != nil {
+		log.Errorf("Failed to get the joined rooms to resume vote chess games: %v", err)
+		return
+	}
+	for _, roomID := range joined.JoinedRooms {
+		resumeVoteGame(roomID)
+	}
+}
+
+func resumeVoteGame(roomID mid.RoomID) {
+	voteLock.Lock()
+	defer voteLock.Unlock()
+
+	gameState, err := getGameStateEvent(roomID)
+	if err != nil || gameState.Vote == nil {
+		return
+	}
+	if gameState.Vote.PollEventID != "" {
+		scheduleVoteClose(roomID, gameState.Vote.PollEventID, gameState.Vote.Closes)
+		return
+	}
+	game, err := gameState.parseGame()
+	if err != nil {
+		log.Errorf("Failed to parse game %s: %v", gameState.GameID, err)
+		return
+	}
+	nextVoteTurn(roomID, gameState, game)
+}
+
+// handleVoteMessage counts a move sent in SAN as a vote while the room is to
+// move. It returns false if the message should be handled as a move by the
+// opponent instead.
+func handleVoteMessage(event *mevent.Event, gameState *StateChessGameEventContent, game Game, body string) bool {
+	vote := gameState.Vote
+	if game.Position().Turn() != vote.color() {
+		// Nobody may move for the engine.
+		return vote.Opponent == ""
+	}
+	move, _ := parseAnnotatedMove(body)
+	if _, err := (chess.AlgebraicNotation{}).Decode(game.Position(), move); err != nil {
+		return true
+	}
+	if handleVote(event.RoomID, vote.PollEventID, event.Sender, move) {
+		SendReaction(event.RoomID, event.ID, voteReaction)
+	}
+	return true
+}
+
+// handleVote records the member's vote for the move in the poll, if the poll
+// is the room's current vote. It returns whether the vote was counted.
+func handleVote(roomID mid.RoomID, pollEventID mid.EventID, userID mid.UserID, move string) bool {
+	voteLock.Lock()
+	defer voteLock.Unlock()
+
+	if pollEventID == "" {
+		return false
+	}
+	gameState, err := getGameStateEvent(roomID)
+	if err != nil || gameState.Vote == nil || gameState.Vote.PollEventID != pollEventID || userID == gameState.Vote.Opponent {
+		return false
+	}
+	if err := App.voteStore.SetVote(roomID, pollEventID, userID, move); err != nil {
+		log.Errorf("Failed to save vote in poll %s: %v", pollEventID, err)
+		return false
+	}
+	// The timer that closes the poll doesn't survive a restart, so a poll
+	// that should have closed already closes with the next vote.
+	if time.Now().After(gameState.Vote.Closes) {
+		closeVoteLocked(roomID, gameState)
+	}
+	return true
+}
+
+// moveTally is the number of votes for a move.
+type moveTally struct {
+	san   string
+	votes int
+}
+
+// tallyVotes counts the votes for each legal move, from the most votes to
+// the fewest.
+func tallyVotes(position *chess.Position, votes map[mid.UserID]string) []moveTally {
+	counts := map[string]int{}
+	for _, vote := range votes {
+		move, err := chess.AlgebraicNotation{}.Decode(position, vote)
+		if err != nil {
+			continue
+		}
+		counts[chess.AlgebraicNotation{}.Encode(position, move)]++
+	}
+	tally := make([]moveTally, 0, len(counts))
+	for san, count := range counts {
+		tally = append(tally, moveTally{san: san, votes: count})
+	}
+	sort.Slice(tally, func(i, j int) bool {
+		if tally[i].votes != tally[j].votes {
+			return tally[i].votes > tally[j].votes
+		}
+		return tally[i].san < tally[j].san
+	})
+	return tally
+}
+
+// describeTally writes the tally as, for example, "Nf3 3, e4 1".
+func describeTally(tally []moveTally) string {
+	parts := make([]string, 0, len(tally))
+	for _, t := range tally {
+		parts = append(parts, fmt.Sprintf("%s %d", t.san, t.votes))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// closeVote closes the poll if it is still the room's current vote and its
+// time is up.
+func closeVote(roomID mid.RoomID, pollEventID mid.EventID) {
+	voteLock.Lock()
+	defer voteLock.Unlock()
+
+	gameState, err := getGameStateEvent(roomID)
+	if err != nil || gameState.Vote == nil || gameState.Vote.PollEventID != pollEventID || time.Now().Before(gameState.Vote.Closes) {
+		return
+	}
+	closeVoteLocked(roomID, gameState)
+}
+
+// closeVoteLocked plays the move with the most votes and announces the
+// tally. If nobody has voted, the vote stays open for another window.
+func closeVoteLocked(roomID mid.RoomID, gameState *StateChessGameEventContent) {
+	game, err := gameState.parseGame()
+	if err != nil {
+		log.Errorf("Failed to parse game %s: %v", gameState.GameID, err)
+		return
+	}
+	vote := gameState.Vote
+	position := game.Position()
+	tally := tallyVotes(position, App.voteStore.GetVotes(roomID, vote.PollEventID))
+	if len(tally) == 0 {
+		window := voteWindow()
+		vote.Closes = time.Now().Add(window)
+		if _, err := App.client.SendStateEvent(roomID, StateChessGame, "", gameState); err != nil {
+			log.Errorf("Failed to save game %s: %v", gameState.GameID, err)
+			return
+		}
+		SendNotice(roomID, fmt.Sprintf("Nobody has voted yet, so the vote stays open for another %s.", describeWindow(window)))
+		scheduleVoteClose(roomID, vote.PollEventID, vote.Closes)
+		return
+	}
+
+	label := moveLabel(position)
+	if err := game.MoveStr(tally[0].san); err != nil {
+		log.Errorf("Failed to play the room's move %s in game %s: %v", tally[0].san, gameState.GameID, err)
+		return
+	}
+	EndPoll(roomID, vote.PollEventID, fmt.Sprintf("The vote has closed: %s.", describeTally(tally)))
+	vote.PollEventID, vote.Closes = "", time.Time{}
+	SendNotice(roomID, fmt.Sprintf("The room plays %s %s. Votes: %s.", label, tally[0].san, describeTally(tally)))
+	showMove(roomID, "", gameState, game)
+}
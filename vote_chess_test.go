@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/notnil/chess"
+	"maunium.net/go/mautrix"
+	mid "maunium.net/go/mautrix/id"
+
+	"github.com/nevarro-space/matrix-chessbot/store"
+)
+
+// fakeEngine is a UCI engine that only knows 1. e4 e5 2. Nf3, which is all
+// that the vote chess tests need of it.
+const fakeEngine = `#!/bin/sh
+turn=w
+while read -r line; do
+	case "$line" in
+	uci) echo "uciok" ;;
+	isready) echo "readyok" ;;
+	"position fen "*) set -- $line; board=$3; turn=$4 ;;
+	go*)
+		echo "info depth 1 score cp 20"
+		if [ "$turn" = b ]; then
+			echo "bestmove e7e5"
+		elif [ "$board" = rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR ]; then
+			echo "bestmove e2e4"
+		else
+			echo "bestmove g1f3"
+		fi
+		;;
+	quit) exit 0 ;;
+	esac
+done
+`
+
+// fakeConvert stands in for ImageMagick, copying a blank PNG to every board
+// image.
+const fakeConvert = `#!/bin/sh
+cp "$(dirname "$0")/board.png" "$2"
+`
+
+// fakeHomeserver keeps the room state that the bot sends and accepts every
+// other request.
+type fakeHomeserver struct {
+	lock   sync.Mutex
+	state  map[string][]byte
+	events []string
+}
+
+func (hs *fakeHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	eventID := fmt.Sprintf(`{"event_id": "$%d"}`, len(hs.events))
+	switch {
+	case strings.Contains(path, "/state/") && r.Method == http.MethodGet:
+		if content, ok := hs.state[path]; ok {
+			w.Write(content)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "Event not found."}`))
+		}
+	case strings.Contains(path, "/state/"):
+		hs.state[path] = body
+		hs.events = append(hs.events, path)
+		w.Write([]byte(eventID))
+	case strings.Contains(path, "/send/") || strings.Contains(path, "/redact/"):
+		hs.events = append(hs.events, path)
+		w.Write([]byte(eventID))
+	case strings.HasSuffix(path, "/joined_rooms"):
+		w.Write([]byte(`{"joined_rooms": ["!room:test"]}`))
+	case strings.HasSuffix(path, "/upload"):
+		w.Write([]byte(`{"content_uri": "mxc://test/board"}`))
+	default:
+		w.Write([]byte(`{}`))
+	}
+}
+
+// setUpTestApp points the bot at a fake homeserver, a fresh database, the fake
+// engine and the fake ImageMagick.
+func setUpTestApp(t *testing.T) {
+	dir := t.TempDir()
+	server := httptest.NewServer(&fakeHomeserver{state: map[string][]byte{}})
+	t.Cleanup(server.Close)
+
+	client, err := mautrix.NewClient(server.URL, "@chessbot:test", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "chessbot.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	var board bytes.Buffer
+	if err := png.Encode(&board, image.NewRGBA(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{"engine": []byte(fakeEngine), "convert": []byte(fakeConvert), "board.png": board.Bytes()}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	t.Cleanup(func() { os.Setenv("PATH", path) })
+
+	enginePath := filepath.Join(dir, "engine")
+	analyzer, err := NewAnalyzer(enginePath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { analyzer.Close() })
+
+	App = ChessBot{
+		client:          client,
+		configuration:   Configuration{Username: "@chessbot:test"},
+		stateStore:      store.NewStateStore(db),
+		analyzer:        analyzer,
+		boardImageCache: &store.BoardImageCache{DB: db},
+		gameStore:       &store.GameStore{DB: db},
+		ratingStore:     &store.RatingStore{DB: db},
+		moveEventStore:  &store.MoveEventStore{DB: db},
+		voteStore:       &store.VoteStore{DB: db},
+	}
+	t.Cleanup(func() { App = ChessBot{} })
+	for _, createTables := range []func() error{
+		App.stateStore.CreateTables,
+		App.boardImageCache.CreateTables,
+		App.gameStore.CreateTables,
+		App.ratingStore.CreateTables,
+		App.moveEventStore.CreateTables,
+		App.voteStore.CreateTables,
+	} {
+		if err := createTables(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestVoteChessKeepsEngineMoves(t *testing.T) {
+	roomID := mid.RoomID("!room:test")
+	testCases := []struct {
+		name  string
+		args  []string
+		votes []string
+		pgn   string
+	}{
+		{"room plays White", []string{"vote", "engine"}, []string{"e4"}, "1. e4 e5 *"},
+		{"room plays Black", []string{"vote", "black", "engine"}, []string{"e5"}, "1. e4 e5 2. Nf3 *"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			setUpTestApp(t)
+			handleNewCommand(roomID, tc.args)
+
+			for _, move := range tc.votes {
+				gameState, err := getGameStateEvent(roomID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if gameState.Vote == nil || gameState.Vote.PollEventID == "" {
+					t.Fatalf("no poll is open in %q", gameState.PGN)
+				}
+				if !handleVote(roomID, gameState.Vote.PollEventID, "@alice:test", move) {
+					t.Fatalf("the vote for %s wasn't counted", move)
+				}
+				closeVoteLocked(roomID, gameState)
+			}
+
+			gameState, err := getGameStateEvent(roomID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if movetext := strings.Join(strings.Fields(pgnMovetext(gameState.PGN)), " "); movetext != tc.pgn {
+				t.Errorf("saved PGN %q, want the moves %q", gameState.PGN, tc.pgn)
+			}
+			if gameState.Vote == nil || gameState.Vote.PollEventID == "" {
+				t.Errorf("no poll is open for the room's next move")
+			}
+			archived := App.gameStore.GetGame(gameState.GameID)
+			if archived == nil || archived.PGN != gameState.PGN {
+				t.Errorf("archived game %+v, want the PGN %q", archived, gameState.PGN)
+			}
+		})
+	}
+}
+
+func TestResumeVoteGames(t *testing.T) {
+	roomID := mid.RoomID("!room:test")
+	testCases := []struct {
+		name string
+		// restart changes the saved game to how it was when the bot
+		// stopped.
+		restart func(gameState *StateChessGameEventContent)
+	}{
+		{"overdue poll", func(gameState *StateChessGameEventContent) {
+			App.voteStore.SetVote(roomID, gameState.Vote.PollEventID, "@alice:test", "e4")
+			gameState.Vote.Closes = time.Now().Add(-time.Minute)
+		}},
+		{"engine to move", func(gameState *StateChessGameEventContent) {
+			game := chess.NewGame()
+			game.MoveStr("e4")
+			gameState.PGN = game.String()
+			gameState.Vote.PollEventID, gameState.Vote.Closes = "", time.Time{}
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			setUpTestApp(t)
+			handleNewCommand(roomID, []string{"vote", "engine"})
+			gameState, err := getGameStateEvent(roomID)
+			if err != nil || gameState.Vote == nil {
+				t.Fatalf("the vote chess game didn't start: %v", err)
+			}
+			tc.restart(gameState)
+			if _, err := App.client.SendStateEvent(roomID, StateChessGame, "", gameState); err != nil {
+				t.Fatal(err)
+			}
+
+			resumeVoteGames()
+
+			// Overdue polls close from a timer, so wait for the poll on the
+			// room's next move.
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				gameState, err = getGameStateEvent(roomID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if strings.Contains(gameState.PGN, "1. e4 e5") && gameState.Vote.PollEventID != "" || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if !strings.Contains(gameState.PGN, "1. e4 e5") {
+				t.Errorf("saved PGN %q, want the moves 1. e4 e5", gameState.PGN)
+			}
+			if gameState.Vote.PollEventID == "" {
+				t.Errorf("no poll is open for the room's next move")
+			}
+		})
+	}
+}